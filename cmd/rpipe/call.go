@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// callFlags are the flags of 'rpipe call' besides the common ones.
+type callFlags struct {
+	timeout time.Duration
+}
+
+func (c *callFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "How long to wait for the reply")
+}
+
+func runCall(args []string) {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s call [flags] TARGET [PAYLOAD...]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Sends one request to TARGET, which runs 'rpipe -rpc' or a JSON chat mode worker, and prints the reply.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "The payload is a single line, read from stdin when not given. Exits with %d on timeout.\n", exitTimeout)
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+		printEnvUsage(fs.Output())
+	}
+	var common commonFlags
+	var cf callFlags
+	common.register(fs)
+	cf.register(fs)
+	common.parse(fs, args)
+
+	common.setupLogging()
+	if fs.NArg() < 1 {
+		fs.Usage()
+		log.Fatalln("TARGET is required")
+	}
+	target := fs.Arg(0)
+	var payload []byte
+	if fs.NArg() > 1 {
+		payload = []byte(strings.Join(fs.Args()[1:], " "))
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalln("Failed to read payload", err)
+		}
+		payload = bytes.TrimRight(data, "\n")
+	}
+	if bytes.IndexByte(payload, '\n') >= 0 {
+		log.Fatalln("The payload must be a single line: the server answers each line separately")
+	}
+
+	opts := common.options()
+	opts.Mode = "call"
+	if common.name == "" {
+		// Calls from one script may overlap, so each gets its own name.
+		common.name = "call-" + rpipe.NewCallID()
+		opts.Ephemeral = true
+	}
+	node, err := rpipe.Open(common.name, opts)
+	if err != nil {
+		log.Fatalln("Failed to open rpipe node: check if Redis is running and the URL is correct", err)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, cf.timeout)
+	reply, err := node.Call(callCtx, target, payload)
+	cancel()
+	_ = node.Close()
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Errorf("No reply from %s within %s", target, cf.timeout)
+		os.Exit(exitTimeout)
+	}
+	if err != nil {
+		log.Fatalln("Call failed", err)
+	}
+	_, _ = os.Stdout.Write(append(reply, '\n'))
+}
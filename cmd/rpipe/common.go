@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// exitTimeout is the exit code when a peer does not answer in time, as
+// timeout(1).
+const exitTimeout = 124
+
+// commonFlags are the node and connection flags shared by all subcommands.
+type commonFlags struct {
+	redisURL    string
+	name        string
+	target      string
+	verbose     bool
+	logFormat   string
+	logFile     string
+	syslog      bool
+	nonsecure   bool
+	tls         rpipe.TLSOptions
+	retryWindow time.Duration
+	metricsAddr string
+	configPath  string
+	profile     string
+	// sources tells where each flag set by parse comes from.
+	sources map[string]string
+}
+
+// stringList collects a repeated string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	defaultRedisURL := os.Getenv("RPIPE_REDIS")
+	if defaultRedisURL == "" {
+		defaultRedisURL = rpipe.DefaultRedisURL
+	}
+	defaultLogFormat := os.Getenv("RPIPE_LOG_FORMAT")
+	if defaultLogFormat == "" {
+		defaultLogFormat = "text"
+	}
+	defaultName := os.Getenv("RPIPE_NAME")
+	defaultTarget := os.Getenv("RPIPE_TARGET")
+	defaultTLSInsecure, _ := strconv.ParseBool(os.Getenv("RPIPE_TLS_INSECURE"))
+
+	fs.StringVar(&c.configPath, "config", os.Getenv("RPIPE_CONFIG"), "Config file with named profiles (env: RPIPE_CONFIG, default: ~/.config/rpipe/config)")
+	fs.StringVar(&c.profile, "profile", os.Getenv("RPIPE_PROFILE"), "Profile of the config file to use (env: RPIPE_PROFILE)")
+	fs.BoolVar(&c.verbose, "verbose", false, "Verbose")
+	fs.BoolVar(&c.verbose, "v", false, "Verbose")
+	fs.StringVar(&c.logFormat, "log-format", defaultLogFormat, "Log format: text or json (env: RPIPE_LOG_FORMAT)")
+	fs.StringVar(&c.logFile, "log-file", os.Getenv("RPIPE_LOG_FILE"), "Append logs to this file instead of stderr (env: RPIPE_LOG_FILE)")
+	fs.BoolVar(&c.syslog, "syslog", false, "Send logs to syslog instead of stderr")
+	fs.StringVar(&c.redisURL, "redis", defaultRedisURL, "Redis URL: redis://, rediss://, redis-sentinel:// or redis-cluster:// (env: RPIPE_REDIS, default: redis://localhost:6379/0)")
+	fs.StringVar(&c.redisURL, "r", defaultRedisURL, "Redis URL: redis://, rediss://, redis-sentinel:// or redis-cluster:// (env: RPIPE_REDIS, default: redis://localhost:6379/0)")
+	fs.StringVar(&c.name, "name", defaultName, "My channel name (env: RPIPE_NAME)")
+	fs.StringVar(&c.name, "n", defaultName, "My channel name (env: RPIPE_NAME)")
+	fs.StringVar(&c.target, "target", defaultTarget, "Target channel (env: RPIPE_TARGET).")
+	fs.StringVar(&c.target, "t", defaultTarget, "Target channel (env: RPIPE_TARGET).")
+	fs.BoolVar(&c.nonsecure, "nonsecure", false, "Non-Secure rpipe.")
+	fs.DurationVar(&c.retryWindow, "retry-window", rpipe.DefaultRetryWindow, "How long to retry publishing while Redis is unreachable (0 disables)")
+	fs.StringVar(&c.tls.CAFile, "tls-ca", os.Getenv("RPIPE_TLS_CA"), "PEM CA bundle for rediss:// (env: RPIPE_TLS_CA)")
+	fs.StringVar(&c.tls.CertFile, "tls-cert", os.Getenv("RPIPE_TLS_CERT"), "PEM client certificate for rediss:// (env: RPIPE_TLS_CERT)")
+	fs.StringVar(&c.tls.KeyFile, "tls-key", os.Getenv("RPIPE_TLS_KEY"), "PEM client key for rediss:// (env: RPIPE_TLS_KEY)")
+	fs.StringVar(&c.tls.ServerName, "tls-server-name", os.Getenv("RPIPE_TLS_SERVER_NAME"), "Server name to verify for rediss:// (env: RPIPE_TLS_SERVER_NAME)")
+	fs.BoolVar(&c.tls.InsecureSkipVerify, "tls-insecure", defaultTLSInsecure, "Skip server certificate verification for rediss:// (env: RPIPE_TLS_INSECURE)")
+	fs.StringVar(&c.metricsAddr, "metrics-addr", os.Getenv("RPIPE_METRICS_ADDR"), "Serve Prometheus metrics on http://ADDR/metrics, e.g. 127.0.0.1:9464 (env: RPIPE_METRICS_ADDR)")
+}
+
+// setupLogging applies the log flags. Logs written elsewhere than stderr
+// do not interleave with the stderr of a command.
+func (c *commonFlags) setupLogging() {
+	if c.verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+	switch c.logFormat {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("Invalid -log-format '%s': use text or json", c.logFormat)
+	}
+	if c.logFile != "" && c.syslog {
+		log.Fatalln("-log-file and -syslog cannot be combined")
+	}
+	if c.logFile != "" {
+		f, err := os.OpenFile(c.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalln("Failed to open log file", err)
+		}
+		log.SetOutput(f)
+	}
+	if c.syslog {
+		hook, err := syslogHook()
+		if err != nil {
+			log.Fatalln("Failed to connect to syslog", err)
+		}
+		log.AddHook(hook)
+		log.SetOutput(io.Discard)
+	}
+}
+
+func (c *commonFlags) options() *rpipe.Options {
+	retryWindow := c.retryWindow
+	if retryWindow == 0 {
+		retryWindow = -1
+	}
+	return &rpipe.Options{
+		RedisURL:    c.redisURL,
+		TLS:         &c.tls,
+		Nonsecure:   c.nonsecure,
+		RetryWindow: retryWindow,
+	}
+}
+
+func printEnvUsage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Environment variables:\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_REDIS   Corresponds to -redis flag\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_NAME    Corresponds to -name flag\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_TARGET  Corresponds to -target flag\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_TLS_CA, RPIPE_TLS_CERT, RPIPE_TLS_KEY, RPIPE_TLS_SERVER_NAME, RPIPE_TLS_INSECURE\n")
+	_, _ = fmt.Fprintf(w, "                Correspond to the -tls-* flags\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_METRICS_ADDR  Corresponds to -metrics-addr flag\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_LOG_FORMAT, RPIPE_LOG_FILE\n")
+	_, _ = fmt.Fprintf(w, "                Correspond to the -log-format and -log-file flags\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_CONTROL  Corresponds to -control flag\n")
+	_, _ = fmt.Fprintf(w, "  RPIPE_CONFIG, RPIPE_PROFILE\n")
+	_, _ = fmt.Fprintf(w, "                Correspond to the -config and -profile flags\n")
+	_, _ = fmt.Fprintf(w, "Precedence: flags > environment variables > profile > defaults\n")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/pipe"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// The control socket speaks JSON lines: each request line is answered by
+// one response line, and a connection may carry many requests.
+type controlRequest struct {
+	Command string `json:"command"`
+	Bridge  string `json:"bridge,omitempty"`
+	Peer    string `json:"peer,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Level   string `json:"level,omitempty"`
+}
+
+type controlResponse struct {
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// controlHandler answers a request with a result to encode as JSON.
+type controlHandler func(req controlRequest) (interface{}, error)
+
+// controlDialTimeout bounds connecting to a control socket, and
+// controlCallTimeout waiting for the answer.
+const (
+	controlDialTimeout = 2 * time.Second
+	controlCallTimeout = 10 * time.Second
+)
+
+// defaultControlSocket is where 'rpipe daemon' listens unless told
+// otherwise: $XDG_RUNTIME_DIR/rpipe/daemon.sock, or a per-user path in the
+// temporary directory.
+func defaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "rpipe", "daemon.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("rpipe-%d", os.Getuid()), "daemon.sock")
+}
+
+// serveControl listens on the Unix socket path, readable by the owner only,
+// until the returned function is called. A stale socket left by a crashed
+// process is replaced; one that still answers, or a file that is not a
+// socket, is an error.
+func serveControl(path string, handle controlHandler) (func(), error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, controlDialTimeout)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listenControl(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Warningln("Control socket failed", err)
+				}
+				return
+			}
+			go serveControlConn(conn, handle)
+		}
+	}()
+	log.Debugf("Control socket on %s", path)
+	return func() {
+		_ = listener.Close()
+		_ = os.Remove(path)
+	}, nil
+}
+
+func serveControlConn(conn net.Conn, handle controlHandler) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var resp controlResponse
+		var req controlRequest
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			resp.Error = "invalid request: " + err.Error()
+		} else {
+			result, err := handle(req)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.OK = true
+				resp.Result, _ = json.Marshal(result)
+			}
+		}
+		if encoder.Encode(resp) != nil {
+			return
+		}
+	}
+}
+
+// nodeStatus is the answer to status.
+type nodeStatus struct {
+	rpipe.NodeStatus
+	Target   string `json:"target,omitempty"`
+	LogLevel string `json:"log_level"`
+}
+
+// nodeControl answers the commands of a single node. session is nil in
+// RPC mode, which has no target to change or drain, and child is nil
+// without a command.
+func nodeControl(node *rpipe.Node, session *rpipe.Session, child *pipe.SpawnedInfo) controlHandler {
+	return func(req controlRequest) (interface{}, error) {
+		switch req.Command {
+		case "status":
+			status := nodeStatus{NodeStatus: node.Status(), LogLevel: log.GetLevel().String()}
+			if session != nil {
+				status.Target = session.Target()
+			}
+			return status, nil
+		case "health":
+			ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+			defer cancel()
+			return newHealthReport(nodeHealthChecks(ctx, node, child)), nil
+		case "symkeys":
+			return node.Symkeys()
+		case "rotate":
+			return node.RotateSymkey(req.Peer)
+		case "log-level":
+			return nil, setLogLevel(req.Level)
+		case "drain":
+			if session == nil {
+				return nil, errors.New("drain is not supported in RPC mode")
+			}
+			log.Infoln("Draining on request of the control socket")
+			session.Drain()
+			return nil, nil
+		case "target":
+			if session == nil {
+				return nil, errors.New("target is not supported in RPC mode")
+			}
+			if req.Target == "" {
+				return nil, errors.New("target is required")
+			}
+			err := session.SetTarget(req.Target)
+			if err != nil {
+				return nil, err
+			}
+			log.Infof("Target changed to %s", req.Target)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unknown command '%s'", req.Command)
+	}
+}
+
+// serveNodeControl serves nodeControl at path, if set.
+func serveNodeControl(path string, node *rpipe.Node, session *rpipe.Session, child *pipe.SpawnedInfo) func() {
+	if path == "" {
+		return func() {}
+	}
+	closeControl, err := serveControl(path, nodeControl(node, session, child))
+	if err != nil {
+		log.Fatalln("Failed to open control socket", err)
+	}
+	return closeControl
+}
+
+// setLogLevel changes the log level at runtime, as -verbose does at start.
+func setLogLevel(level string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+	log.Infof("Log level set to %s", l)
+	return nil
+}
+
+// callControl sends req to the control socket at path and returns the
+// result, or the error reported by the other side.
+func callControl(path string, req controlRequest) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, controlDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlCallTimeout))
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
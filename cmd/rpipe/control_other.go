@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"net"
+)
+
+func listenControl(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
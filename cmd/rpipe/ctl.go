@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe/secure"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// runCtl sends one command to the control socket of 'rpipe daemon' or of
+// a node started with -control.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s ctl [flags] COMMAND [ARG]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Commands of 'rpipe daemon':\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  list             List the bridges\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  start BRIDGE     Start a stopped bridge\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  stop BRIDGE      Stop a bridge until started again\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Commands of a node started with -control:\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  status           Show the node, its target and peers\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  symkeys          List the cached symkeys and their epochs\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  rotate [PEER]    Replace the symkey to PEER, or to every peer\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  target NAME      Change the default target (chat mode)\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  drain            Stop reading input, send what was read and exit\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Commands of both:\n")
+		_, _ = fmt.Fprintf(fs.Output(), "  log-level LEVEL  Change the log level, e.g. debug or info\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+	var socket string
+	fs.StringVar(&socket, "socket", defaultControlSocket(), "Control socket")
+	_ = fs.Parse(args)
+
+	req, ok := ctlRequest(fs.Args())
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+	result, err := callControl(socket, req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch req.Command {
+	case "list":
+		var bridges []bridgeStatus
+		decodeResult(result, &bridges)
+		printBridges(bridges)
+	case "status":
+		var status nodeStatus
+		decodeResult(result, &status)
+		printStatus(status)
+	case "symkeys":
+		var symkeys []secure.SymkeyInfo
+		decodeResult(result, &symkeys)
+		printSymkeys(symkeys)
+	case "rotate":
+		var peers []string
+		decodeResult(result, &peers)
+		for _, peer := range peers {
+			fmt.Println(peer)
+		}
+	}
+}
+
+// ctlRequest builds the request for the arguments COMMAND [ARG], or
+// reports that they are not a valid command.
+func ctlRequest(args []string) (controlRequest, bool) {
+	if len(args) == 0 {
+		return controlRequest{}, false
+	}
+	req := controlRequest{Command: args[0]}
+	var arg string
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	switch req.Command {
+	case "start", "stop":
+		req.Bridge = arg
+		return req, len(args) == 2
+	case "rotate":
+		req.Peer = arg
+		return req, len(args) <= 2
+	case "target":
+		req.Target = arg
+		return req, len(args) == 2
+	case "log-level":
+		req.Level = arg
+		return req, len(args) == 2
+	case "list", "status", "symkeys", "drain":
+		return req, len(args) == 1
+	}
+	return req, false
+}
+
+func decodeResult(result json.RawMessage, v interface{}) {
+	err := json.Unmarshal(result, v)
+	if err != nil {
+		log.Fatalln("Invalid answer from the control socket", err)
+	}
+}
+
+func printBridges(bridges []bridgeStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tMODE\tTARGET\tSTATE\tRESTARTS\tSINCE\tERROR")
+	for _, b := range bridges {
+		since := time.Since(b.Since).Round(time.Second)
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", b.Name, b.Mode, b.Target, b.State, b.Restarts, since, b.Error)
+	}
+	_ = w.Flush()
+}
+
+func printStatus(status nodeStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "name\t%s\n", status.Name)
+	_, _ = fmt.Fprintf(w, "mode\t%s\n", status.Mode)
+	_, _ = fmt.Fprintf(w, "version\t%s\n", status.Version)
+	_, _ = fmt.Fprintf(w, "connected\t%t\n", status.Connected)
+	_, _ = fmt.Fprintf(w, "uptime\t%s\n", time.Since(status.Started).Round(time.Second))
+	_, _ = fmt.Fprintf(w, "target\t%s\n", status.Target)
+	_, _ = fmt.Fprintf(w, "log level\t%s\n", status.LogLevel)
+	_, _ = fmt.Fprintf(w, "peers\t%s\n", strings.Join(status.Peers, ", "))
+	_, _ = fmt.Fprintf(w, "groups\t%s\n", strings.Join(status.Groups, ", "))
+	_, _ = fmt.Fprintf(w, "patterns\t%s\n", strings.Join(status.Patterns, ", "))
+	_, _ = fmt.Fprintf(w, "queues\t%s\n", strings.Join(status.Queues, ", "))
+	_ = w.Flush()
+}
+
+func printSymkeys(symkeys []secure.SymkeyInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tEPOCH\tAGE")
+	for _, k := range symkeys {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\n", k.Name, k.Epoch, time.Since(k.Since).Round(time.Second))
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCtlRequest(t *testing.T) {
+	tests := []struct {
+		args []string
+		want controlRequest
+		ok   bool
+	}{
+		{[]string{"list"}, controlRequest{Command: "list"}, true},
+		{[]string{"status"}, controlRequest{Command: "status"}, true},
+		{[]string{"drain"}, controlRequest{Command: "drain"}, true},
+		{[]string{"start", "web1"}, controlRequest{Command: "start", Bridge: "web1"}, true},
+		{[]string{"stop", "web1"}, controlRequest{Command: "stop", Bridge: "web1"}, true},
+		{[]string{"rotate"}, controlRequest{Command: "rotate"}, true},
+		{[]string{"rotate", "bob"}, controlRequest{Command: "rotate", Peer: "bob"}, true},
+		{[]string{"target", "carol"}, controlRequest{Command: "target", Target: "carol"}, true},
+		{[]string{"log-level", "debug"}, controlRequest{Command: "log-level", Level: "debug"}, true},
+		{nil, controlRequest{}, false},
+		{[]string{"start"}, controlRequest{Command: "start"}, false},
+		{[]string{"list", "extra"}, controlRequest{Command: "list"}, false},
+		{[]string{"rotate", "bob", "carol"}, controlRequest{Command: "rotate", Peer: "bob"}, false},
+		{[]string{"reboot"}, controlRequest{Command: "reboot"}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ctlRequest(tt.args)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("ctlRequest(%q) = %+v, %t, want %+v, %t", tt.args, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestControlSocket_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	closeControl, err := serveControl(path, func(req controlRequest) (interface{}, error) {
+		if req.Command == "fail" {
+			return nil, errors.New("failed on purpose")
+		}
+		return []string{req.Command, req.Bridge}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeControl()
+
+	result, err := callControl(path, controlRequest{Command: "start", Bridge: "web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := json.Unmarshal(result, &got); err != nil || !reflect.DeepEqual(got, []string{"start", "web1"}) {
+		t.Errorf("got %s (%v)", result, err)
+	}
+	if _, err := callControl(path, controlRequest{Command: "fail"}); err == nil || err.Error() != "failed on purpose" {
+		t.Errorf("want the handler's error, got %v", err)
+	}
+	if _, err := serveControl(path, nil); err == nil {
+		t.Error("second serveControl on a live socket: expected error")
+	}
+}
+
+func TestServeControl_NotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serveControl(path, nil); err == nil {
+		t.Fatal("serveControl over a regular file: expected error")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "keep me" {
+		t.Errorf("the file was changed: %q (%v)", data, err)
+	}
+}
+
+func TestServeControl_Mode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+	closeControl, err := serveControl(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeControl()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %s, want an 0600 socket", info.Mode())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("want only the socket in %s, got %v (%v)", dir, entries, err)
+	}
+}
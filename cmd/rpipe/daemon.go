@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/pipe"
+	"github.com/sng2c/rpipe/secure"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// daemonConfig is the file given to 'rpipe daemon -config'.
+type daemonConfig struct {
+	Redis         string         `yaml:"redis"`
+	TLSCA         string         `yaml:"tls-ca"`
+	TLSCert       string         `yaml:"tls-cert"`
+	TLSKey        string         `yaml:"tls-key"`
+	TLSServerName string         `yaml:"tls-server-name"`
+	TLSInsecure   bool           `yaml:"tls-insecure"`
+	Control       string         `yaml:"control"`
+	MetricsAddr   string         `yaml:"metrics-addr"`
+	Bridges       []bridgeConfig `yaml:"bridges"`
+}
+
+// bridgeConfig describes one bridge: a node and the command it relays.
+type bridgeConfig struct {
+	Name    string   `yaml:"name"`
+	Target  string   `yaml:"target"`
+	Mode    string   `yaml:"mode"` // pipe, chat or rpc
+	Command []string `yaml:"command"`
+	Groups  []string `yaml:"groups"`
+	Queue   bool     `yaml:"queue"`
+	// ChatFormat is text or json, see -chat-format.
+	ChatFormat string `yaml:"chat-format"`
+	// Window is the pipe mode flow control window, see -window.
+	Window int `yaml:"window"`
+	// ConnectTimeout is the pipe mode handshake timeout, see -connect-timeout.
+	ConnectTimeout time.Duration `yaml:"connect-timeout"`
+	// Restart is always, on-failure or never.
+	Restart string `yaml:"restart"`
+	// Disabled bridges are only started by 'rpipe ctl start'.
+	Disabled bool `yaml:"disabled"`
+}
+
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// A bridge that exits is restarted after restartDelayMin, doubling up to
+// restartDelayMax while it keeps failing.
+const (
+	restartDelayMin = time.Second
+	restartDelayMax = 30 * time.Second
+)
+
+// restartBackoff computes the delays between restarts of one bridge.
+type restartBackoff struct {
+	delay time.Duration
+}
+
+// next returns the delay before restarting a bridge that ran for ran. A
+// bridge that ran longer than restartDelayMax starts over from
+// restartDelayMin.
+func (r *restartBackoff) next(ran time.Duration) time.Duration {
+	if r.delay == 0 || ran > restartDelayMax {
+		r.delay = restartDelayMin
+	} else {
+		r.delay = min(r.delay*2, restartDelayMax)
+	}
+	return r.delay
+}
+
+// restarts reports whether a bridge that exited with err is restarted.
+func (b bridgeConfig) restarts(err error) bool {
+	return b.Restart == restartAlways || b.Restart == restartOnFailure && err != nil
+}
+
+const (
+	bridgeStopped  = "stopped"
+	bridgeRunning  = "running"
+	bridgeBackoff  = "restarting"
+	bridgeFinished = "exited"
+)
+
+func loadDaemonConfig(path string) (*daemonConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &daemonConfig{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i := range config.Bridges {
+		b := &config.Bridges[i]
+		if b.Mode == "" {
+			b.Mode = "pipe"
+		}
+		if b.Restart == "" {
+			b.Restart = restartAlways
+		}
+		if b.ChatFormat == "" {
+			b.ChatFormat = rpipe.ChatFormatText
+		}
+		switch {
+		case b.Name == "":
+			return nil, fmt.Errorf("bridge %d: name is required", i+1)
+		case seen[b.Name]:
+			return nil, fmt.Errorf("bridge %s: defined twice", b.Name)
+		case b.Mode != "pipe" && b.Mode != "chat" && b.Mode != "rpc":
+			return nil, fmt.Errorf("bridge %s: invalid mode '%s': use pipe, chat or rpc", b.Name, b.Mode)
+		case b.ChatFormat != rpipe.ChatFormatText && b.ChatFormat != rpipe.ChatFormatJSON:
+			return nil, fmt.Errorf("bridge %s: invalid chat-format '%s': use text or json", b.Name, b.ChatFormat)
+		case b.ChatFormat == rpipe.ChatFormatJSON && b.Mode != "chat":
+			return nil, fmt.Errorf("bridge %s: chat-format json requires mode chat", b.Name)
+		case b.Mode == "pipe" && b.Target == "":
+			return nil, fmt.Errorf("bridge %s: target is required in pipe mode", b.Name)
+		case len(b.Command) == 0:
+			return nil, fmt.Errorf("bridge %s: command is required", b.Name)
+		case b.Restart != restartAlways && b.Restart != restartOnFailure && b.Restart != restartNever:
+			return nil, fmt.Errorf("bridge %s: invalid restart '%s': use always, on-failure or never", b.Name, b.Restart)
+		case b.Queue && rpipe.IsGroup(b.Name):
+			return nil, fmt.Errorf("bridge %s: a queue needs a node name, not a group", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	return config, nil
+}
+
+// bridgeStatus is a bridge as listed on the control socket.
+type bridgeStatus struct {
+	Name     string    `json:"name"`
+	Mode     string    `json:"mode"`
+	Target   string    `json:"target,omitempty"`
+	State    string    `json:"state"`
+	Restarts int       `json:"restarts"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type bridge struct {
+	cfg bridgeConfig
+
+	mu       sync.Mutex // guards the fields below
+	state    string
+	since    time.Time
+	restarts int
+	lastErr  error
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// stopping is set from stop until done is closed
+	stopping bool
+	// node and child are set while the bridge relays
+	node  *rpipe.Node
+	child *pipe.SpawnedInfo
+}
+
+func (b *bridge) setState(state string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = state
+	b.since = time.Now()
+	b.lastErr = err
+}
+
+func (b *bridge) attach(node *rpipe.Node, child *pipe.SpawnedInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.node = node
+	b.child = child
+}
+
+// health checks the node and command of a running bridge. A bridge waiting
+// to be restarted, or that exited with an error for good, fails the child
+// check; a stopped one has no checks.
+func (b *bridge) health(ctx context.Context) []healthCheck {
+	b.mu.Lock()
+	state, lastErr, node, child := b.state, b.lastErr, b.node, b.child
+	b.mu.Unlock()
+	var checks []healthCheck
+	switch {
+	case node != nil:
+		checks = nodeHealthChecks(ctx, node, child)
+	case state == bridgeBackoff || state == bridgeFinished && lastErr != nil:
+		err := errors.New(state)
+		if lastErr != nil {
+			err = fmt.Errorf("%s: %w", state, lastErr)
+		}
+		checks = []healthCheck{{HealthCheck: rpipe.NewHealthCheck(healthChild, err)}}
+	}
+	for i := range checks {
+		checks[i].Bridge = b.cfg.Name
+	}
+	return checks
+}
+
+func (b *bridge) status() bridgeStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := bridgeStatus{Name: b.cfg.Name, Mode: b.cfg.Mode, Target: b.cfg.Target, State: b.state, Restarts: b.restarts, Since: b.since}
+	if b.lastErr != nil {
+		s.Error = b.lastErr.Error()
+	}
+	return s
+}
+
+// daemon supervises bridges that share one Redis client and one key pair.
+type daemon struct {
+	rdb    redis.UniversalClient
+	crypto *secure.Cryptor
+
+	mu      sync.Mutex
+	bridges map[string]*bridge
+}
+
+// start runs the bridge name under supervision until stop.
+func (d *daemon) start(name string) error {
+	b, err := d.bridge(name)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.cancel != nil {
+		done := b.done
+		select {
+		case <-done:
+			// exited for good, see bridgeConfig.Restart, or stopped
+			b.cancel()
+			b.cancel = nil
+		default:
+			if !b.stopping {
+				return fmt.Errorf("bridge %s is already running", name)
+			}
+			// the node of the last run must close before a new one opens
+			b.mu.Unlock()
+			<-done
+			b.mu.Lock()
+		}
+	}
+	b.stopping = false
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+	go d.supervise(ctx, b)
+	return nil
+}
+
+// stop stops the bridge name and waits for its node to close.
+func (d *daemon) stop(name string) error {
+	b, err := d.bridge(name)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	cancel, done := b.cancel, b.done
+	b.stopping = cancel != nil
+	b.mu.Unlock()
+	if cancel == nil {
+		return fmt.Errorf("bridge %s is not running", name)
+	}
+	cancel()
+	<-done
+	b.mu.Lock()
+	if b.done == done {
+		b.cancel = nil
+		b.stopping = false
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+func (d *daemon) stopAll() {
+	var wg sync.WaitGroup
+	for _, name := range d.names() {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_ = d.stop(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+func (d *daemon) bridge(name string) (*bridge, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.bridges[name]
+	if !ok {
+		return nil, fmt.Errorf("no bridge named '%s'", name)
+	}
+	return b, nil
+}
+
+func (d *daemon) names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.bridges))
+	for name := range d.bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *daemon) list() []bridgeStatus {
+	var list []bridgeStatus
+	for _, name := range d.names() {
+		b, _ := d.bridge(name)
+		list = append(list, b.status())
+	}
+	return list
+}
+
+// health checks Redis and every bridge, in parallel.
+func (d *daemon) health(ctx context.Context) healthReport {
+	names := d.names()
+	bridgeChecks := make([][]healthCheck, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		b, _ := d.bridge(name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bridgeChecks[i] = b.health(ctx)
+		}()
+	}
+	checks := []healthCheck{{HealthCheck: rpipe.NewHealthCheck(rpipe.HealthRedis, d.rdb.Ping(ctx).Err())}}
+	wg.Wait()
+	for _, c := range bridgeChecks {
+		checks = append(checks, c...)
+	}
+	return newHealthReport(checks)
+}
+
+// handleControl answers list, start, stop, health and log-level on the
+// control socket.
+func (d *daemon) handleControl(req controlRequest) (interface{}, error) {
+	switch req.Command {
+	case "list":
+		return d.list(), nil
+	case "health":
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		defer cancel()
+		return d.health(ctx), nil
+	case "start":
+		return nil, d.start(req.Bridge)
+	case "stop":
+		return nil, d.stop(req.Bridge)
+	case "log-level":
+		return nil, setLogLevel(req.Level)
+	}
+	return nil, fmt.Errorf("unknown command '%s'", req.Command)
+}
+
+// supervise runs b until ctx is done, restarting it as its restart policy
+// says.
+func (d *daemon) supervise(ctx context.Context, b *bridge) {
+	defer close(b.done)
+	logger := log.WithField("bridge", b.cfg.Name)
+	var backoff restartBackoff
+	for {
+		b.setState(bridgeRunning, nil)
+		started := time.Now()
+		err := d.runBridge(ctx, b)
+		if ctx.Err() != nil {
+			b.setState(bridgeStopped, nil)
+			logger.Infoln("Bridge stopped")
+			return
+		}
+		if err != nil {
+			logger.Warningln("Bridge failed", err)
+		} else {
+			logger.Infoln("Bridge exited")
+		}
+		if !b.cfg.restarts(err) {
+			b.setState(bridgeFinished, err)
+			return
+		}
+		delay := backoff.next(time.Since(started))
+		b.setState(bridgeBackoff, err)
+		select {
+		case <-ctx.Done():
+			b.setState(bridgeStopped, nil)
+			return
+		case <-time.After(delay):
+		}
+		b.mu.Lock()
+		b.restarts++
+		b.mu.Unlock()
+		rpipe.ChildRestarts.Inc()
+		logger.Infoln("Restarting bridge")
+	}
+}
+
+// runBridge opens the node of b and relays its command until either ends.
+// It fails if the command exits with an error.
+func (d *daemon) runBridge(ctx context.Context, b *bridge) error {
+	cfg := b.cfg
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger := log.WithField("bridge", cfg.Name)
+
+	nodeName := cfg.Name
+	opts := &rpipe.Options{
+		Redis:  d.rdb,
+		Crypto: d.crypto,
+		Pipe:   cfg.Mode == "pipe",
+		Mode:   cfg.Mode,
+	}
+	if cfg.Queue {
+		nodeName = rpipe.NewInstanceName(cfg.Name)
+		opts.Ephemeral = true
+	}
+	node, err := rpipe.Open(nodeName, opts)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	if cfg.Queue {
+		err := node.JoinQueue(cfg.Name)
+		if err != nil {
+			return fmt.Errorf("join queue: %w", err)
+		}
+	}
+	groups := cfg.Groups
+	if rpipe.IsGroup(cfg.Target) {
+		groups = append(groups, cfg.Target)
+	}
+	for _, group := range groups {
+		err := node.JoinGroup(group)
+		if err != nil {
+			return fmt.Errorf("join group: %w", err)
+		}
+	}
+
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	cmd.Env = append(os.Environ(), "RPIPE_NAME="+nodeName, "RPIPE_TARGET="+cfg.Target)
+	spawnInfo, err := pipe.Spawn(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("spawn: %w", err)
+	}
+	b.attach(node, spawnInfo)
+	defer b.attach(nil, nil)
+	go func() {
+		// the command's stderr is logged, as bridges share the daemon's
+		for line := range spawnInfo.Err {
+			logger.Infoln(strings.TrimRight(string(line), "\n"))
+		}
+	}()
+
+	if cfg.Mode == "rpc" {
+		err = rpipe.NewRPCServer(node, rpipe.RPCServerOptions{
+			In:  spawnInfo.Out,
+			Out: spawnInfo.In,
+		}).Run(ctx)
+	} else {
+		err = rpipe.NewSession(node, rpipe.SessionOptions{
+			Target:         cfg.Target,
+			Chat:           cfg.Mode == "chat",
+			ChatFormat:     cfg.ChatFormat,
+			In:             spawnInfo.Out,
+			Out:            spawnInfo.In,
+			Window:         cfg.Window,
+			ConnectTimeout: cfg.ConnectTimeout,
+		}).Run(ctx)
+	}
+	// kills the command if it is still running
+	cancel()
+	<-spawnInfo.CancelContext.Done()
+	if err != nil {
+		return err
+	}
+	if state := cmd.ProcessState; state != nil && !state.Success() {
+		return fmt.Errorf("command exited: %s", state)
+	}
+	return nil
+}
+
+// runDaemon runs the bridges of a config file in one process.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s daemon -config BRIDGES.yaml [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Runs the bridges of a config file in one process, sharing one Redis client and key pair.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Bridges are restarted when they exit; 'rpipe ctl' lists, starts and stops them.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+	var common commonFlags
+	var configPath string
+	var control string
+	fs.StringVar(&configPath, "config", "", "Bridges config file (required)")
+	fs.StringVar(&control, "control", "", fmt.Sprintf("Control socket, overriding the config file (default: %s)", defaultControlSocket()))
+	fs.BoolVar(&common.verbose, "verbose", false, "Verbose")
+	fs.BoolVar(&common.verbose, "v", false, "Verbose")
+	fs.StringVar(&common.logFormat, "log-format", "text", "Log format: text or json")
+	fs.StringVar(&common.logFile, "log-file", "", "Append logs to this file instead of stderr")
+	fs.BoolVar(&common.syslog, "syslog", false, "Send logs to syslog instead of stderr")
+	_ = fs.Parse(args)
+
+	common.setupLogging()
+	if configPath == "" || fs.NArg() != 0 {
+		fs.Usage()
+		log.Fatalln("-config is required")
+	}
+	config, err := loadDaemonConfig(configPath)
+	if err != nil {
+		log.Fatalln("Failed to load config", err)
+	}
+	if control == "" {
+		control = config.Control
+	}
+	if control == "" {
+		control = defaultControlSocket()
+	}
+	redisURL := config.Redis
+	if redisURL == "" {
+		redisURL = rpipe.DefaultRedisURL
+	}
+	rdb, err := rpipe.NewRedisClient(redisURL, &rpipe.TLSOptions{
+		CAFile:             config.TLSCA,
+		CertFile:           config.TLSCert,
+		KeyFile:            config.TLSKey,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecure,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rdb.Close()
+	err = rdb.Ping(ctx).Err()
+	if err != nil {
+		log.Fatalln("Failed to connect to Redis: check if Redis is running and the URL is correct", err)
+	}
+
+	d := &daemon{
+		rdb:     rdb,
+		crypto:  secure.NewCryptor(rdb),
+		bridges: make(map[string]*bridge),
+	}
+	for _, cfg := range config.Bridges {
+		d.bridges[cfg.Name] = &bridge{cfg: cfg, state: bridgeStopped, since: time.Now()}
+	}
+	closeControl, err := serveControl(control, d.handleControl)
+	if err != nil {
+		log.Fatalln("Failed to open control socket", err)
+	}
+	defer closeControl()
+	serveHTTP(config.MetricsAddr, d.health)
+
+	for _, cfg := range config.Bridges {
+		if cfg.Disabled {
+			continue
+		}
+		err := d.start(cfg.Name)
+		if err != nil {
+			log.Warningln(err)
+		}
+	}
+	log.Infof("Running %d bridges, control socket %s", len(config.Bridges), control)
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-sigCtx.Done()
+	log.Infoln("Stopping bridges")
+	d.stopAll()
+	log.Debugln("Bye~")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"github.com/go-redis/redis/v8"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDaemonConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"minimal", "bridges:\n- {name: a, target: b, command: [cat]}\n", ""},
+		{"chat json", "bridges:\n- {name: a, mode: chat, chat-format: json, command: [cat]}\n", ""},
+		{"no name", "bridges:\n- {target: b, command: [cat]}\n", "bridge 1: name is required"},
+		{"twice", "bridges:\n- {name: a, target: b, command: [cat]}\n- {name: a, target: c, command: [cat]}\n", "defined twice"},
+		{"mode", "bridges:\n- {name: a, mode: tcp, command: [cat]}\n", "invalid mode"},
+		{"pipe target", "bridges:\n- {name: a, command: [cat]}\n", "target is required"},
+		{"command", "bridges:\n- {name: a, target: b}\n", "command is required"},
+		{"restart", "bridges:\n- {name: a, target: b, command: [cat], restart: sometimes}\n", "invalid restart"},
+		{"json pipe", "bridges:\n- {name: a, target: b, chat-format: json, command: [cat]}\n", "requires mode chat"},
+		{"format", "bridges:\n- {name: a, mode: chat, chat-format: xml, command: [cat]}\n", "invalid chat-format"},
+		{"queue group", "bridges:\n- {name: '@ops', mode: chat, queue: true, command: [cat]}\n", "needs a node name"},
+		{"yaml", "bridges: [", "bridges.yaml"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "bridges.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadDaemonConfig(path)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: got %v, want an error about %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadDaemonConfig_Defaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridges.yaml")
+	yaml := "bridges:\n- {name: a, target: b, command: [cat], window: 1024, connect-timeout: 30s}\n"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadDaemonConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := config.Bridges[0]
+	if b.Mode != "pipe" || b.Restart != restartAlways || b.ChatFormat != "text" || b.Window != 1024 || b.ConnectTimeout != 30*time.Second {
+		t.Errorf("unexpected bridge %+v", b)
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	var r restartBackoff
+	steps := []struct {
+		ran  time.Duration
+		want time.Duration
+	}{
+		{0, time.Second},
+		{0, 2 * time.Second},
+		{time.Second, 4 * time.Second},
+		{0, 8 * time.Second},
+		{0, 16 * time.Second},
+		{0, 30 * time.Second},
+		{0, 30 * time.Second},
+		{time.Minute, time.Second},
+		{0, 2 * time.Second},
+	}
+	for i, step := range steps {
+		if got := r.next(step.ran); got != step.want {
+			t.Errorf("step %d: next(%s) = %s, want %s", i, step.ran, got, step.want)
+		}
+	}
+}
+
+func TestBridgeConfig_Restarts(t *testing.T) {
+	failed := os.ErrClosed
+	tests := []struct {
+		restart string
+		err     error
+		want    bool
+	}{
+		{restartAlways, nil, true},
+		{restartAlways, failed, true},
+		{restartOnFailure, nil, false},
+		{restartOnFailure, failed, true},
+		{restartNever, nil, false},
+		{restartNever, failed, false},
+	}
+	for _, tt := range tests {
+		if got := (bridgeConfig{Restart: tt.restart}).restarts(tt.err); got != tt.want {
+			t.Errorf("restart %s, err %v: got %t, want %t", tt.restart, tt.err, got, tt.want)
+		}
+	}
+}
+
+// unreachableDaemon returns a daemon whose Redis refuses connections, so
+// every bridge fails to open its node.
+func unreachableDaemon(t *testing.T, bridges ...bridgeConfig) *daemon {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+	d := &daemon{rdb: rdb, bridges: make(map[string]*bridge)}
+	for _, cfg := range bridges {
+		d.bridges[cfg.Name] = &bridge{cfg: cfg, state: bridgeStopped, since: time.Now()}
+	}
+	return d
+}
+
+// waitState waits for the bridge name to reach state.
+func waitState(t *testing.T, d *daemon, name, state string) bridgeStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := d.bridge(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := b.status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bridge %s is %s, want %s", name, status.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemon_HandleControl(t *testing.T) {
+	d := unreachableDaemon(t,
+		bridgeConfig{Name: "once", Mode: "pipe", Target: "b", Command: []string{"cat"}, Restart: restartNever},
+		bridgeConfig{Name: "retry", Mode: "pipe", Target: "b", Command: []string{"cat"}, Restart: restartAlways},
+	)
+	list, err := d.handleControl(controlRequest{Command: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := list.([]bridgeStatus)
+	if len(statuses) != 2 || statuses[0].Name != "once" || statuses[1].State != bridgeStopped {
+		t.Fatalf("unexpected list %+v", statuses)
+	}
+
+	if _, err := d.handleControl(controlRequest{Command: "start", Bridge: "once"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := waitState(t, d, "once", bridgeFinished); status.Error == "" {
+		t.Errorf("want the error of the failed bridge, got %+v", status)
+	}
+	// an exited bridge may be started again
+	if _, err := d.handleControl(controlRequest{Command: "start", Bridge: "once"}); err != nil {
+		t.Errorf("start after exit: %v", err)
+	}
+	waitState(t, d, "once", bridgeFinished)
+
+	if _, err := d.handleControl(controlRequest{Command: "start", Bridge: "retry"}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, "retry", bridgeBackoff)
+	if _, err := d.handleControl(controlRequest{Command: "start", Bridge: "retry"}); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("second start: got %v", err)
+	}
+	if _, err := d.handleControl(controlRequest{Command: "stop", Bridge: "retry"}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, "retry", bridgeStopped)
+
+	errs := []struct {
+		req     controlRequest
+		wantErr string
+	}{
+		{controlRequest{Command: "stop", Bridge: "retry"}, "not running"},
+		{controlRequest{Command: "start", Bridge: "none"}, "no bridge named 'none'"},
+		{controlRequest{Command: "log-level", Level: "loud"}, "loud"},
+		{controlRequest{Command: "reboot"}, "unknown command"},
+	}
+	for _, tt := range errs {
+		if _, err := d.handleControl(tt.req); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: got %v, want an error about %q", tt.req, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDaemon_StartWhileStopping(t *testing.T) {
+	d := unreachableDaemon(t,
+		bridgeConfig{Name: "retry", Mode: "pipe", Target: "b", Command: []string{"cat"}, Restart: restartAlways},
+	)
+	b, _ := d.bridge("retry")
+	// a run that is still closing its node after stop
+	done := make(chan struct{})
+	b.cancel, b.done, b.stopping = func() {}, done, true
+	started := make(chan error, 1)
+	go func() {
+		started <- d.start("retry")
+	}()
+	select {
+	case err := <-started:
+		t.Fatalf("start returned before the last run closed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(done)
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	newDone := b.done
+	b.mu.Unlock()
+	if newDone == done {
+		t.Fatal("start did not begin a new run")
+	}
+	if err := d.stop("retry"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, "retry", bridgeStopped)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// forwardSpecs collects repeated -L/-R flags.
+type forwardSpecs []rpipe.ForwardSpec
+
+func (f *forwardSpecs) String() string {
+	var specs []string
+	for _, spec := range *f {
+		specs = append(specs, spec.String())
+	}
+	return strings.Join(specs, ", ")
+}
+
+func (f *forwardSpecs) Set(s string) error {
+	spec, err := rpipe.ParseForwardSpec(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// forwardFlags are the flags of 'rpipe forward' besides the common ones.
+type forwardFlags struct {
+	locals            forwardSpecs
+	remotes           forwardSpecs
+	window            int
+	allow             string
+	allowRemoteListen bool
+	remoteBinds       string
+}
+
+func (f *forwardFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.locals, "L", "Local forward [bind_address:]port:host:hostport: listen here, connect from the peer (repeatable)")
+	fs.Var(&f.remotes, "R", "Remote forward [bind_address:]port:host:hostport: listen on the peer, connect from here (repeatable)")
+	fs.IntVar(&f.window, "window", rpipe.DefaultWindow, "Per-connection flow control window in bytes")
+	fs.StringVar(&f.allow, "allow", "", "Comma-separated host:port destinations the peer may connect to from here, e.g. 'localhost:5432' (default none; -R destinations are always allowed)")
+	fs.BoolVar(&f.allowRemoteListen, "allow-remote-listen", false, "Let the peer's -R forwards listen here, on loopback addresses and -remote-bind ones")
+	fs.StringVar(&f.remoteBinds, "remote-bind", "", "Comma-separated bind addresses besides loopback that the peer's -R forwards may use, e.g. 0.0.0.0")
+}
+
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s forward [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Relays TCP connections through the -target peer, which also runs 'rpipe forward'.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+		printEnvUsage(fs.Output())
+	}
+	var common commonFlags
+	var ff forwardFlags
+	common.register(fs)
+	ff.register(fs)
+	common.parse(fs, args)
+
+	common.setupLogging()
+	if common.name == "" || common.target == "" {
+		fs.Usage()
+		log.Fatalln("-name and -target flags are required in forward mode")
+	}
+
+	allowList, err := rpipe.ParseAllowList(ff.allow)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(allowList) == 0 && len(ff.locals) == 0 && len(ff.remotes) == 0 {
+		log.Warningln("No -allow rules: every connection requested by the peer will be refused")
+	}
+	opts := rpipe.ForwarderOptions{
+		Target:            common.target,
+		Window:            ff.window,
+		Allow:             allowList,
+		AllowRemoteListen: ff.allowRemoteListen,
+	}
+	for _, bind := range strings.Split(ff.remoteBinds, ",") {
+		if bind = strings.TrimSpace(bind); bind != "" {
+			opts.RemoteBinds = append(opts.RemoteBinds, bind)
+		}
+	}
+	runForwarder(&common, "forward", opts, func(forwarder *rpipe.Forwarder) {
+		for _, spec := range ff.locals {
+			err := forwarder.ListenLocal(spec)
+			if err != nil {
+				log.Fatalln("Failed to listen for local forward", err)
+			}
+		}
+		for _, spec := range ff.remotes {
+			result, err := forwarder.RequestRemote(spec)
+			if err != nil {
+				log.Fatalln("Failed to request remote forward", err)
+			}
+			go waitRemoteForward(spec, result)
+		}
+	})
+}
+
+// waitRemoteForward reports the peer's answer to a remote forward; a
+// refusal is fatal, as with a local forward that cannot listen.
+func waitRemoteForward(spec rpipe.ForwardSpec, result <-chan error) {
+	select {
+	case err := <-result:
+		if err != nil {
+			log.Fatalln("Remote forward failed", err)
+		}
+		log.Infof("Remote forward %s is listening", spec)
+	case <-time.After(remoteForwardTimeout):
+		log.Warningf("No answer to remote forward %s within %s: the peer may run an older rpipe", spec, remoteForwardTimeout)
+	}
+}
+
+// remoteForwardTimeout bounds the wait for the peer's answer to -R.
+const remoteForwardTimeout = 10 * time.Second
+
+// runForwarder opens the node, lets setup add listeners and relays until
+// interrupted.
+func runForwarder(common *commonFlags, mode string, opts rpipe.ForwarderOptions, setup func(forwarder *rpipe.Forwarder)) {
+	nodeOpts := common.options()
+	nodeOpts.Mode = mode
+	node, err := rpipe.Open(common.name, nodeOpts)
+	if err != nil {
+		log.Fatalln("Failed to open rpipe node: check if Redis is running and the URL is correct", err)
+	}
+	defer func(node *rpipe.Node) {
+		_ = node.Close()
+	}(node)
+	serveHTTP(common.metricsAddr, nodeHealth(node, nil))
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	forwarder := rpipe.NewForwarder(node, opts)
+	setup(forwarder)
+	err = forwarder.Run(sigCtx)
+	if err != nil {
+		log.Warningln(err)
+	}
+	log.Debugln("Bye~")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/secure"
+	"os"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// runGroup lists the members of a group.
+func runGroup(args []string) {
+	fs := flag.NewFlagSet("group", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s group [flags] @GROUP\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Lists the members of a group. Nodes join with 'rpipe -group @GROUP'.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+		printEnvUsage(fs.Output())
+	}
+	var common commonFlags
+	common.register(fs)
+	common.parse(fs, args)
+
+	common.setupLogging()
+	if fs.NArg() != 1 || !rpipe.IsGroup(fs.Arg(0)) {
+		fs.Usage()
+		log.Fatalln("expected one group name such as @ops")
+	}
+	rdb, err := rpipe.NewRedisClient(common.redisURL, &common.tls)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rdb.Close()
+	members, err := secure.GroupMembers(ctx, rdb, fs.Arg(0))
+	if err != nil {
+		log.Fatalln("Failed to read group members: check if Redis is running and the URL is correct", err)
+	}
+	for _, member := range members {
+		fmt.Println(member)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/pipe"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// healthChild is the check that the command of a node is still running.
+const healthChild = "child"
+
+// healthTimeout bounds the checks of one node, mostly the subscription
+// probe.
+const healthTimeout = 3 * time.Second
+
+// Exit codes of 'rpipe health'. With several failures, the first in this
+// order decides.
+const exitHealthUnreachable = 3
+
+var healthExitCodes = []struct {
+	check string
+	code  int
+}{
+	{rpipe.HealthRedis, 4},
+	{rpipe.HealthPubkey, 5},
+	{rpipe.HealthSubscription, 6},
+	{healthChild, 7},
+}
+
+// healthCheck is a check of a node, or of a bridge of 'rpipe daemon'.
+type healthCheck struct {
+	rpipe.HealthCheck
+	Bridge string `json:"bridge,omitempty"`
+}
+
+// healthReport answers health on the control socket and /healthz.
+type healthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []healthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []healthCheck) healthReport {
+	report := healthReport{OK: true, Checks: checks}
+	for _, check := range checks {
+		report.OK = report.OK && check.OK
+	}
+	return report
+}
+
+// exitCode returns the exit code of 'rpipe health' for the report.
+func (r healthReport) exitCode() int {
+	for _, e := range healthExitCodes {
+		for _, check := range r.Checks {
+			if check.Name == e.check && !check.OK {
+				return e.code
+			}
+		}
+	}
+	return 0
+}
+
+// nodeHealthChecks checks node and, in command mode, that the command is
+// still running.
+func nodeHealthChecks(ctx context.Context, node *rpipe.Node, child *pipe.SpawnedInfo) []healthCheck {
+	var checks []healthCheck
+	for _, check := range node.Health(ctx) {
+		checks = append(checks, healthCheck{HealthCheck: check})
+	}
+	if child != nil {
+		var err error
+		if child.CancelContext.Err() != nil {
+			err = errors.New("command exited")
+		}
+		checks = append(checks, healthCheck{HealthCheck: rpipe.NewHealthCheck(healthChild, err)})
+	}
+	return checks
+}
+
+// nodeHealth returns the health function of a node, for /healthz.
+func nodeHealth(node *rpipe.Node, child *pipe.SpawnedInfo) func(ctx context.Context) healthReport {
+	return func(ctx context.Context) healthReport {
+		return newHealthReport(nodeHealthChecks(ctx, node, child))
+	}
+}
+
+// runHealth asks a node or 'rpipe daemon' for its health and exits with
+// the code of the first failed check.
+func runHealth(args []string) {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s health [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Checks a node started with -control, or 'rpipe daemon' and its bridges, through the control socket.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Exit codes: 0 healthy, %d no answer", exitHealthUnreachable)
+		for _, e := range healthExitCodes {
+			_, _ = fmt.Fprintf(fs.Output(), ", %d %s", e.code, e.check)
+		}
+		_, _ = fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	defaultSocket := os.Getenv("RPIPE_CONTROL")
+	if defaultSocket == "" {
+		defaultSocket = defaultControlSocket()
+	}
+	var socket string
+	fs.StringVar(&socket, "socket", defaultSocket, "Control socket (env: RPIPE_CONTROL, default: the socket of 'rpipe daemon')")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	result, err := callControl(socket, controlRequest{Command: "health"})
+	if err != nil {
+		log.Errorln("No answer from the control socket", err)
+		os.Exit(exitHealthUnreachable)
+	}
+	var report healthReport
+	err = json.Unmarshal(result, &report)
+	if err != nil {
+		log.Errorln("Invalid answer from the control socket", err)
+		os.Exit(exitHealthUnreachable)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, check := range report.Checks {
+		name := check.Name
+		if check.Bridge != "" {
+			name = check.Bridge + "/" + name
+		}
+		status := "ok"
+		if !check.OK {
+			status = "FAILED: " + check.Error
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", name, status)
+	}
+	_ = w.Flush()
+	os.Exit(report.exitCode())
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/pipe"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+var ctx = context.Background()
+
+const VERSION = rpipe.Version
+
+// subcommands take the arguments after their name.
+var subcommands = map[string]func(args []string){
+	"forward": runForward,
+	"socks":   runSocks,
+	"group":   runGroup,
+	"call":    runCall,
+	"peers":   runPeers,
+	"config":  runConfig,
+	"daemon":  runDaemon,
+	"ctl":     runCtl,
+	"health":  runHealth,
+}
+
+type Str string
+
+func (s Str) Or(defaultStr Str) Str {
+	if s == "" {
+		return defaultStr
+	}
+	return s
+}
+
+// mainFlags are the flags of the main command besides the common ones.
+type mainFlags struct {
+	chatMode       bool
+	chatFormat     string
+	tuiMode        bool
+	blockSize      int
+	window         int
+	groups         stringList
+	patterns       stringList
+	rpcMode        bool
+	queueMode      bool
+	waitTarget     time.Duration
+	strictDelivery bool
+	connectTimeout time.Duration
+	control        string
+	drainTimeout   time.Duration
+}
+
+func (m *mainFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&m.chatMode, "chat", false, "Chat mode: send as 'TARGET<message' (or '<message' if -target set), receive as 'SENDER>message'.")
+	fs.BoolVar(&m.chatMode, "c", false, "Chat mode: send as 'TARGET<message' (or '<message' if -target set), receive as 'SENDER>message'.")
+	fs.StringVar(&m.chatFormat, "chat-format", rpipe.ChatFormatText, `Chat mode: text, or json for one {"from","to","data"} object per line each way, which also carries calls, streams and broadcasts`)
+	fs.BoolVar(&m.tuiMode, "tui", false, "Chat mode on a full screen terminal interface, with a conversation per peer, input history and presence")
+	fs.IntVar(&m.blockSize, "blocksize", rpipe.DefaultBlockSize, "blocksize in bytes")
+	fs.IntVar(&m.window, "window", 0, fmt.Sprintf("Pipe mode flow control, off by default: unacknowledged bytes in flight before input is paused, e.g. %d. Without it a slow receiver can be overrun and disconnected; the target must run a release with flow control, as an older one never acknowledges and the transfer stalls (0 disables)", rpipe.DefaultWindow))
+	fs.Var(&m.groups, "group", "Join a group channel such as @ops, reachable as '@ops<message' in chat mode (repeatable)")
+	fs.Var(&m.patterns, "psubscribe", "Chat mode: also receive from channels matching a Redis glob such as 'logs.*' (repeatable)")
+	fs.BoolVar(&m.rpcMode, "rpc", false, "RPC server: answer each 'rpipe call' with the next output line of COMMAND (or stdout)")
+	fs.DurationVar(&m.waitTarget, "wait-target", 0, "Wait up to this long for the target to subscribe before sending (0 disables)")
+	fs.DurationVar(&m.connectTimeout, "connect-timeout", 0, fmt.Sprintf("Pipe mode handshake, off by default: wait up to this long for the target to answer before sending, e.g. %s, then exit with %d. Without it the target must be running first, or sending fails with 'target offline'; the target must run a release with the handshake, as an older one never answers (0 sends right away)", rpipe.DefaultConnectTimeout, exitTimeout))
+	fs.BoolVar(&m.strictDelivery, "strict-delivery", false, "Fail instead of warning when no subscriber receives a message; in pipe mode this ends rpipe with an error")
+	fs.DurationVar(&m.drainTimeout, "drain-timeout", defaultDrainTimeout, "On SIGINT or SIGTERM, stop reading input and wait up to this long for pending data to be delivered; a second signal exits at once")
+	fs.StringVar(&m.control, "control", os.Getenv("RPIPE_CONTROL"), "Serve the control socket of 'rpipe ctl' at this path (env: RPIPE_CONTROL)")
+	fs.BoolVar(&m.queueMode, "queue", false, "Serve -name as a queue: run several instances and each message to the name reaches one of them; replies come from 'NAME#ID'")
+}
+
+func main() {
+	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Rpipe V%s\n", VERSION)
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [COMMAND...]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s forward [flags] [-L spec] [-R spec]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s socks [flags] [-listen addr] [-allow rules]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s group [flags] @GROUP\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s call [flags] TARGET [PAYLOAD...]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s peers [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s config show [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s daemon -config BRIDGES.yaml [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s ctl [flags] COMMAND\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "       %s health [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+		flag.PrintDefaults()
+		printEnvUsage(flag.CommandLine.Output())
+	}
+
+	var common commonFlags
+	var mf mainFlags
+	common.register(flag.CommandLine)
+	mf.register(flag.CommandLine)
+	common.parse(flag.CommandLine, os.Args[1:])
+
+	if mf.tuiMode {
+		mf.chatMode = true
+	}
+	pipeMode := !mf.chatMode && !mf.rpcMode
+	myChnName := common.name
+	targetChnName := common.target
+
+	common.setupLogging()
+	if mf.tuiMode && !common.verbose {
+		// joins and leaves show on screen
+		log.SetLevel(log.WarnLevel)
+	}
+
+	if myChnName == "" {
+		flag.Usage()
+		log.Fatalln("-name flag or RPIPE_NAME env var is required")
+	}
+
+	// blockSize in KiB
+	if mf.blockSize <= 0 {
+		mf.blockSize = rpipe.DefaultBlockSize
+	}
+
+	// check command
+	command := flag.Args()
+
+	if mf.chatMode && mf.rpcMode {
+		log.Fatalln("-chat and -rpc cannot be combined")
+	}
+	if mf.rpcMode && len(mf.patterns) > 0 {
+		log.Fatalln("-psubscribe requires -chat")
+	}
+	if mf.chatFormat != rpipe.ChatFormatText && mf.chatFormat != rpipe.ChatFormatJSON {
+		log.Fatalf("Invalid -chat-format '%s': use text or json", mf.chatFormat)
+	}
+	if mf.chatFormat == rpipe.ChatFormatJSON && !mf.chatMode {
+		log.Fatalln("-chat-format json requires -chat")
+	}
+	if mf.tuiMode && (len(command) > 0 || mf.rpcMode || mf.chatFormat == rpipe.ChatFormatJSON) {
+		log.Fatalln("-tui cannot be combined with a command, -rpc or -chat-format json")
+	}
+
+	// check pipemode
+	if pipeMode {
+		if targetChnName == "" {
+			log.Fatalln("-name and -target flags are required in pipe mode")
+		}
+		if len(mf.patterns) > 0 {
+			log.Fatalln("-psubscribe requires -chat: messages from many senders are told apart by their SENDER> prefix")
+		}
+	}
+
+	if mf.queueMode && rpipe.IsGroup(myChnName) {
+		log.Fatalln("-queue needs a node name, not a group")
+	}
+
+	opts := common.options()
+	opts.Pipe = pipeMode
+	opts.BlockSize = mf.blockSize
+	opts.RequireReceiver = mf.strictDelivery
+	switch {
+	case mf.rpcMode:
+		opts.Mode = "rpc"
+	case mf.chatMode:
+		opts.Mode = "chat"
+	default:
+		opts.Mode = "pipe"
+	}
+	nodeName := myChnName
+	if mf.queueMode {
+		nodeName = rpipe.NewInstanceName(myChnName)
+		opts.Ephemeral = true
+	}
+	node, err := rpipe.Open(nodeName, opts)
+	if err != nil {
+		log.Fatalln("Failed to open rpipe node: check if Redis is running and the URL is correct", err)
+	}
+	defer func(node *rpipe.Node) {
+		_ = node.Close()
+	}(node)
+
+	if mf.queueMode {
+		err := node.JoinQueue(myChnName)
+		if err != nil {
+			log.Fatalln("Failed to join queue", err)
+		}
+		log.Infof("Serving %s as instance %s", myChnName, nodeName)
+	}
+
+	if rpipe.IsGroup(targetChnName) {
+		mf.groups = append(mf.groups, targetChnName)
+	}
+	for _, group := range mf.groups {
+		err := node.JoinGroup(group)
+		if err != nil {
+			log.Fatalln("Failed to join group", err)
+		}
+	}
+	for _, pattern := range mf.patterns {
+		err := node.SubscribePattern(pattern)
+		if err != nil {
+			log.Fatalln("Failed to subscribe to pattern", err)
+		}
+	}
+
+	if mf.waitTarget > 0 && targetChnName != "" {
+		waitCtx, cancel := context.WithTimeout(ctx, mf.waitTarget)
+		err := node.WaitForReceiver(waitCtx, targetChnName)
+		cancel()
+		if err != nil {
+			_ = node.Close()
+			log.Errorf("Target %s did not subscribe within %s", targetChnName, mf.waitTarget)
+			os.Exit(exitTimeout)
+		}
+	}
+
+	sd := newShutdown(mf.drainTimeout)
+	defer sd.stop()
+
+	var spawnInfo *pipe.SpawnedInfo
+	if len(command) > 0 {
+		cmd := exec.Command(command[0], command[1:]...) //Just for testing, replace with your subProcess
+		// pass Env
+		cmd.Env = os.Environ()
+		cmd.Env = append(cmd.Env, "RPIPE_NAME="+nodeName, "RPIPE_TARGET="+targetChnName)
+		// killed if it outlives the drain
+		spawnInfo, err = pipe.Spawn(sd.ctx, cmd)
+		if err != nil {
+			log.Fatalln("Failed to spawn process: check if the command exists and is executable", err)
+			return
+		}
+	}
+	serveHTTP(common.metricsAddr, nodeHealth(node, spawnInfo))
+
+	var fromLocalCh <-chan []byte
+	var fromLocalErrorCh <-chan []byte
+	var toLocalCh chan<- []byte
+	// stopInput ends local input when draining, and toLocalDone is closed
+	// once everything sent to toLocalCh has been written out
+	var stopInput func()
+	var toLocalDone <-chan struct{}
+	var child *os.Process
+
+	if spawnInfo != nil {
+		fromLocalCh = spawnInfo.Out
+		fromLocalErrorCh = spawnInfo.Err
+		toLocalCh = spawnInfo.In
+		stopInput = func() {
+			// the command ends its output and exits
+			_ = spawnInfo.Cmd.Process.Signal(syscall.SIGTERM)
+		}
+		toLocalDone = spawnInfo.CancelContext.Done()
+		child = spawnInfo.Cmd.Process
+	} else if mf.tuiMode {
+		ui, err := newTUI(sd.ctx, node, targetChnName)
+		if err != nil {
+			log.Fatalln("Failed to start -tui", err)
+		}
+		go ui.run()
+		fromLocalCh = ui.in
+		stopInput = ui.stop
+		toLocalCh = ui.out
+		toLocalDone = ui.done
+	} else {
+		inputCtx, cancelInput := context.WithCancel(sd.ctx)
+		stopInput = cancelInput
+		if pipeMode {
+			fromLocalCh = pipe.ReadLineBufferChannelContext(inputCtx, os.Stdin, mf.blockSize, '\n')
+		} else {
+			fromLocalCh = pipe.ReadLineChannelContext(inputCtx, os.Stdin)
+		}
+		toLocalCh, toLocalDone = pipe.WriteLineChannelDone(os.Stdout)
+	}
+
+	if mf.rpcMode {
+		server := rpipe.NewRPCServer(node, rpipe.RPCServerOptions{
+			In:  fromLocalCh,
+			Err: fromLocalErrorCh,
+			Out: toLocalCh,
+		})
+		closeControl := serveNodeControl(mf.control, node, nil, spawnInfo)
+		defer closeControl()
+		// calls in progress are not waited for
+		sd.watch(sd.cancel, child)
+		err = server.Run(sd.ctx)
+		if err != nil {
+			log.Warningln(err)
+		}
+		log.Debugln("Bye~")
+		return
+	}
+
+	session := rpipe.NewSession(node, rpipe.SessionOptions{
+		Target:         targetChnName,
+		Chat:           mf.chatMode,
+		ChatFormat:     mf.chatFormat,
+		In:             fromLocalCh,
+		Err:            fromLocalErrorCh,
+		Out:            toLocalCh,
+		Window:         mf.window,
+		ConnectTimeout: mf.connectTimeout,
+		StopInput: func() {
+			sd.begin()
+			stopInput()
+		},
+	})
+	closeControl := serveNodeControl(mf.control, node, session, spawnInfo)
+	defer closeControl()
+	sd.watch(session.Drain, child)
+	err = session.Run(sd.ctx)
+	// in command mode, closing its input lets the command finish
+	close(toLocalCh)
+	if spawnInfo != nil {
+		// nothing relays the output of the command anymore: drop it, so
+		// that the command does not block writing, and kill the command if
+		// it outlives the drain timeout
+		go discardLines(spawnInfo.Out, "output")
+		go discardLines(spawnInfo.Err, "error output")
+		sd.begin()
+	}
+	sd.wait(toLocalDone)
+	if child != nil {
+		// still running if the drain timed out
+		_ = child.Kill()
+		<-toLocalDone
+	}
+	if err == nil {
+		err = sd.err()
+	}
+	if err != nil {
+		log.Errorln(err)
+		closeControl()
+		_ = node.Close()
+		if errors.Is(err, rpipe.ErrConnectTimeout) {
+			os.Exit(exitTimeout)
+		}
+		os.Exit(1)
+	}
+	log.Debugln("Bye~")
+}
+
+// discardLines reads ch until it is closed and warns about what it dropped.
+func discardLines(ch <-chan []byte, what string) {
+	dropped := 0
+	for range ch {
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warningf("Dropped %d lines of command %s written after the session ended", dropped, what)
+	}
+}
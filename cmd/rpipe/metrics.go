@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// serveHTTP starts the optional HTTP listener with /metrics, and /healthz
+// answering 503 when a check of health fails.
+func serveHTTP(addr string, health func(ctx context.Context) healthReport) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		report := health(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		log.Fatalln("Metrics listener failed", err)
+	}()
+	log.Debugf("Serving metrics on %s", addr)
+}
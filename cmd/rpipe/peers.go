@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// peersFlags are the flags of 'rpipe peers' besides the common ones.
+type peersFlags struct {
+	all bool
+}
+
+func (p *peersFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&p.all, "all", false, "Also list short lived nodes, such as those of 'rpipe call'")
+}
+
+// runPeers lists the running nodes.
+func runPeers(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s peers [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "Lists the running nodes.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+		printEnvUsage(fs.Output())
+	}
+	var common commonFlags
+	var pf peersFlags
+	common.register(fs)
+	pf.register(fs)
+	common.parse(fs, args)
+
+	common.setupLogging()
+	if fs.NArg() != 0 {
+		fs.Usage()
+		log.Fatalln("unexpected arguments")
+	}
+	rdb, err := rpipe.NewRedisClient(common.redisURL, &common.tls)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rdb.Close()
+	peers, err := rpipe.Peers(ctx, rdb)
+	if err != nil {
+		log.Fatalln("Failed to read peers: check if Redis is running and the URL is correct", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tHOST\tMODE\tVERSION\tUPTIME\tFINGERPRINT")
+	for _, p := range peers {
+		if p.Ephemeral && !pf.all {
+			continue
+		}
+		uptime := time.Since(p.Started).Round(time.Second)
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Host, p.Mode, p.Version, uptime, p.Fingerprint)
+	}
+	_ = w.Flush()
+}
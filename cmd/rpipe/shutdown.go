@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDrainTimeout is how long a node may drain after a signal.
+const defaultDrainTimeout = 10 * time.Second
+
+// shutdown ends a node in two phases. The first SIGINT or SIGTERM starts
+// draining: input stops, and what was read or received is still delivered.
+// ctx is cancelled once the drain timeout passes, ending the node by force,
+// and a second signal exits at once.
+type shutdown struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timeout  time.Duration
+	sigCh    chan os.Signal
+	once     sync.Once
+	timedOut atomic.Bool
+}
+
+func newShutdown(timeout time.Duration) *shutdown {
+	s := &shutdown{timeout: timeout, sigCh: make(chan os.Signal, 2)}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	signal.Notify(s.sigCh, syscall.SIGINT, syscall.SIGTERM)
+	return s
+}
+
+// watch calls drain on the first signal. On the second, it kills child,
+// if set, and exits.
+func (s *shutdown) watch(drain func(), child *os.Process) {
+	go func() {
+		sig := <-s.sigCh
+		log.Infof("Received %s, draining for up to %s; send it again to exit now", sig, s.timeout)
+		s.begin()
+		drain()
+		sig = <-s.sigCh
+		log.Warningf("Received %s again, exiting", sig)
+		if child != nil {
+			_ = child.Kill()
+		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+// begin starts the drain timeout, once. It is started by a signal, a drain
+// or a session that ended with its command still running, never while
+// output is only being written out.
+func (s *shutdown) begin() {
+	s.once.Do(func() {
+		time.AfterFunc(s.timeout, func() {
+			s.timedOut.Store(s.timeout > 0 && s.ctx.Err() == nil)
+			s.cancel()
+		})
+	})
+}
+
+// wait waits for done, or for the drain timeout if one was started.
+func (s *shutdown) wait(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+	}
+}
+
+// err tells whether the drain timeout ended the node.
+func (s *shutdown) err() error {
+	if s.timedOut.Load() {
+		return fmt.Errorf("drain did not finish within %s", s.timeout)
+	}
+	return nil
+}
+
+func (s *shutdown) stop() {
+	signal.Stop(s.sigCh)
+	s.cancel()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdown_WaitWithoutSignal(t *testing.T) {
+	sd := newShutdown(20 * time.Millisecond)
+	defer sd.stop()
+	done := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(done) })
+	sd.wait(done)
+	select {
+	case <-done:
+	default:
+		t.Fatal("wait returned before done without a drain")
+	}
+	if err := sd.err(); err != nil || sd.ctx.Err() != nil {
+		t.Fatalf("want no timeout, got %v (%v)", err, sd.ctx.Err())
+	}
+}
+
+func TestShutdown_WaitAfterDrain(t *testing.T) {
+	sd := newShutdown(20 * time.Millisecond)
+	defer sd.stop()
+	sd.begin()
+	start := time.Now()
+	sd.wait(make(chan struct{}))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("wait took %s after the drain timeout", elapsed)
+	}
+	if sd.err() == nil {
+		t.Fatal("want the drain timeout error")
+	}
+}
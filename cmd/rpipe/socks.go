@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"os"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// socksFlags are the flags of 'rpipe socks' besides the common ones.
+type socksFlags struct {
+	listen string
+	allow  string
+	window int
+}
+
+func (s *socksFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.listen, "listen", "", "Address to serve SOCKS5 on, e.g. 127.0.0.1:1080 (no authentication)")
+	fs.StringVar(&s.allow, "allow", "", "Comma-separated host:port destinations the peer may connect to from here, e.g. '*.internal:443,10.0.0.0/8:*' (default none)")
+	fs.IntVar(&s.window, "window", rpipe.DefaultWindow, "Per-connection flow control window in bytes")
+}
+
+func runSocks(args []string) {
+	fs := flag.NewFlagSet("socks", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s socks [flags]\n", os.Args[0])
+		_, _ = fmt.Fprintf(fs.Output(), "With -listen, runs a SOCKS5 proxy whose connections are made by the -target peer.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "The peer runs 'rpipe socks -allow ...' and connects only to allowed destinations.\n")
+		_, _ = fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+		printEnvUsage(fs.Output())
+	}
+	var common commonFlags
+	var sf socksFlags
+	common.register(fs)
+	sf.register(fs)
+	common.parse(fs, args)
+
+	common.setupLogging()
+	if common.name == "" || common.target == "" {
+		fs.Usage()
+		log.Fatalln("-name and -target flags are required in socks mode")
+	}
+	allowList, err := rpipe.ParseAllowList(sf.allow)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if sf.listen == "" && len(allowList) == 0 {
+		log.Warningln("No -allow rules: every connection requested by the peer will be refused")
+	}
+
+	runForwarder(&common, "socks", rpipe.ForwarderOptions{Target: common.target, Window: sf.window, Allow: allowList}, func(forwarder *rpipe.Forwarder) {
+		if sf.listen == "" {
+			return
+		}
+		err := forwarder.ListenSOCKS(sf.listen)
+		if err != nil {
+			log.Fatalln("Failed to listen for SOCKS5", err)
+		}
+	})
+}
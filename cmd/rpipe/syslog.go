@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+	"log/syslog"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogHook sends log entries to the local syslog daemon.
+func syslogHook() (log.Hook, error) {
+	return lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "rpipe")
+}
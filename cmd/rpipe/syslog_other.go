@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+func syslogHook() (log.Hook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoTerminal = errors.New("terminal control is not supported on this platform")
+
+type termState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*termState, error) {
+	return nil, errNoTerminal
+}
+
+func restoreTerm(fd int, state *termState) error {
+	return errNoTerminal
+}
+
+func termSize(fd int) (int, int, error) {
+	return 0, 0, errNoTerminal
+}
+
+func notifyResize(ch chan<- os.Signal) {}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sng2c/rpipe"
+	"github.com/sng2c/rpipe/msgspec"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+const tuiHelp = "Enter send, Up/Down history, Tab/Shift-Tab switch peer, PgUp/PgDn scroll, " +
+	"/to NAME open a conversation, /close, /peers, /quit (or Ctrl-C), // to send a line starting with /"
+
+// Kinds of lines in a conversation.
+const (
+	lineReceived = iota
+	lineSent
+	lineSystem
+)
+
+// ANSI styles of the -tui screen.
+const (
+	styleReset    = "\x1b[0m"
+	styleBold     = "\x1b[1m"
+	styleDim      = "\x1b[2m"
+	styleReverse  = "\x1b[7m"
+	styleSent     = "\x1b[32m"
+	styleReceived = "\x1b[1;36m"
+	styleOnline   = "\x1b[32m"
+)
+
+type tuiLine struct {
+	time time.Time
+	kind int
+	from string
+	text string
+}
+
+// conversation is the scrollback with one peer or group.
+type conversation struct {
+	name   string
+	lines  []tuiLine
+	unread int
+	// scroll is how many rows the view is scrolled up from the bottom.
+	scroll int
+}
+
+func (c *conversation) add(line tuiLine) {
+	line.time = time.Now()
+	c.lines = append(c.lines, line)
+}
+
+// tuiKey is a key press: a rune, or a named key such as "enter".
+type tuiKey struct {
+	name string
+	r    rune
+}
+
+// tui is the -tui chat front-end. It owns the terminal and talks to a chat
+// mode session in its line format: 'PEER<message' lines on in and
+// 'SENDER>message' lines on out. done is closed once out has closed and
+// the terminal is restored.
+type tui struct {
+	node *rpipe.Node
+	in   chan []byte
+	out  chan []byte
+	done chan struct{}
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	logs     *tuiLogWriter
+	presence <-chan rpipe.PresenceEvent
+	// keyBuf holds the start of a key whose rest is still to be read
+	keyBuf []byte
+
+	fd     int
+	state  *termState
+	width  int
+	height int
+
+	convs []*conversation
+	cur   int
+	// notices holds system lines while no conversation is open.
+	notices *conversation
+	online  map[string]bool
+
+	input       []rune
+	cursor      int
+	inputOffset int
+	history     []string
+	histPos     int
+	draft       []rune
+
+	// pending lines wait for the session, which may be busy writing to out
+	pending  [][]byte
+	quitting bool
+	inClosed bool
+}
+
+// newTUI takes over the terminal. target, if set, is the first
+// conversation.
+func newTUI(ctx context.Context, node *rpipe.Node, target string) (*tui, error) {
+	fd := int(os.Stdin.Fd())
+	if !isTerminal(fd) || !isTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("stdin and stdout must be a terminal")
+	}
+	t := &tui{
+		node:     node,
+		in:       make(chan []byte),
+		out:      make(chan []byte),
+		done:     make(chan struct{}),
+		stopCh:   make(chan struct{}),
+		logs:     newTUILogWriter(),
+		fd:       fd,
+		notices:  &conversation{},
+		online:   make(map[string]bool),
+		presence: node.WatchPresence(ctx),
+	}
+	peers, err := node.Peers()
+	if err == nil {
+		for _, peer := range peers {
+			t.online[peer.Name] = true
+		}
+	}
+	if target != "" {
+		t.open(target)
+	}
+	t.width, t.height, err = termSize(fd)
+	if err != nil {
+		return nil, err
+	}
+	t.state, err = makeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	// alternate screen, restored on exit
+	_, _ = os.Stdout.WriteString("\x1b[?1049h")
+	if log.StandardLogger().Out == os.Stderr {
+		log.SetOutput(t.logs)
+	}
+	t.notice("Welcome to rpipe, " + node.Name + ". " + tuiHelp)
+	return t, nil
+}
+
+// stop ends input, as if the user quit. It may be called from any
+// goroutine.
+func (t *tui) stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopCh)
+	})
+}
+
+// run serves the terminal until out closes.
+func (t *tui) run() {
+	defer close(t.done)
+	defer t.restore()
+
+	keys := make(chan []byte, 16)
+	go readTerminal(keys)
+	resize := make(chan os.Signal, 1)
+	notifyResize(resize)
+	stopCh := t.stopCh
+	var keyWait <-chan time.Time
+
+	t.render()
+	for {
+		var inCh chan<- []byte
+		var next []byte
+		if len(t.pending) > 0 {
+			inCh = t.in
+			next = t.pending[0]
+		}
+		select {
+		case inCh <- next:
+			t.pending = t.pending[1:]
+			t.closeInput()
+			continue
+		case data, ok := <-keys:
+			if !ok {
+				keys = nil
+				t.quit()
+				break
+			}
+			keyWait = nil
+			if t.feedKeys(data) {
+				keyWait = time.After(escTimeout)
+			}
+		case <-keyWait:
+			keyWait = nil
+			t.flushKeys()
+		case line, ok := <-t.out:
+			if !ok {
+				return
+			}
+			t.receive(line)
+		case event, ok := <-t.presence:
+			if !ok {
+				t.presence = nil
+				continue
+			}
+			t.presenceChanged(event)
+		case <-t.logs.wake:
+			lines, dropped := t.logs.take()
+			for _, line := range lines {
+				t.notice(line)
+			}
+			if dropped > 0 {
+				t.notice(fmt.Sprintf("%d log messages dropped", dropped))
+			}
+		case <-resize:
+			width, height, err := termSize(t.fd)
+			if err == nil {
+				t.width, t.height = width, height
+			}
+		case <-stopCh:
+			stopCh = nil
+			t.quit()
+		}
+		t.render()
+	}
+}
+
+func (t *tui) restore() {
+	if log.StandardLogger().Out == t.logs {
+		log.SetOutput(os.Stderr)
+	}
+	_, _ = os.Stdout.WriteString(styleReset + "\x1b[?25h\x1b[?1049l")
+	_ = restoreTerm(t.fd, t.state)
+}
+
+// readTerminal sends what is typed to keys. A chunk may end in the middle
+// of an escape sequence or a UTF-8 character.
+func readTerminal(keys chan<- []byte) {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		keys <- append([]byte(nil), buf[:n]...)
+	}
+}
+
+// tuiLogBacklog is how many log entries wait for the screen before more
+// are only counted.
+const tuiLogBacklog = 1000
+
+// tuiLogWriter shows log entries as notices. It never blocks the logger:
+// entries wait in a backlog until the screen takes them, and those beyond
+// it are counted as dropped.
+type tuiLogWriter struct {
+	wake chan struct{}
+
+	mu      sync.Mutex
+	lines   []string
+	dropped int
+}
+
+func newTUILogWriter() *tuiLogWriter {
+	return &tuiLogWriter{wake: make(chan struct{}, 1)}
+}
+
+func (w *tuiLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if len(w.lines) < tuiLogBacklog {
+		w.lines = append(w.lines, strings.TrimRight(string(p), "\n"))
+	} else {
+		w.dropped++
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// take returns the waiting entries and how many were dropped since the
+// last call.
+func (w *tuiLogWriter) take() ([]string, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines, dropped := w.lines, w.dropped
+	w.lines, w.dropped = nil, 0
+	return lines, dropped
+}
+
+const (
+	// maxKeyLen bounds an unfinished key kept for the next read.
+	maxKeyLen = 32
+	// escTimeout is how long an ESC waits for the rest of a sequence
+	// before it is the Esc key.
+	escTimeout = 100 * time.Millisecond
+)
+
+// feedKeys handles the keys in data, after what was left of the last read.
+// It reports whether an escape sequence is still unfinished.
+func (t *tui) feedKeys(data []byte) bool {
+	t.keyBuf = append(t.keyBuf, data...)
+	for len(t.keyBuf) > 0 {
+		n, key := parseKey(t.keyBuf)
+		if n == 0 {
+			break
+		}
+		t.keyBuf = t.keyBuf[n:]
+		t.handleKey(key)
+	}
+	if len(t.keyBuf) > maxKeyLen {
+		// not a key after all
+		t.keyBuf = nil
+	}
+	return len(t.keyBuf) > 0 && t.keyBuf[0] == 0x1b
+}
+
+// flushKeys ends an unfinished escape sequence once no more of it has come:
+// a lone ESC is the Esc key, anything else is dropped.
+func (t *tui) flushKeys() {
+	if string(t.keyBuf) == "\x1b" {
+		t.handleKey(tuiKey{name: "esc"})
+	}
+	t.keyBuf = nil
+}
+
+// parseKey decodes the key at the start of b and returns its length, or 0
+// if b ends before the key does. Unknown sequences decode to an empty key.
+func parseKey(b []byte) (int, tuiKey) {
+	switch c := b[0]; {
+	case c == 0x1b:
+		if len(b) == 1 {
+			// Esc, or the start of a sequence
+			return 0, tuiKey{}
+		}
+		if b[1] != '[' && b[1] != 'O' {
+			// Alt+key
+			return 2, tuiKey{}
+		}
+		for i := 2; i < len(b); i++ {
+			if b[i] < 0x40 || b[i] > 0x7e {
+				continue
+			}
+			params := string(b[2:i])
+			switch b[i] {
+			case 'A':
+				return i + 1, tuiKey{name: "up"}
+			case 'B':
+				return i + 1, tuiKey{name: "down"}
+			case 'C':
+				return i + 1, tuiKey{name: "right"}
+			case 'D':
+				return i + 1, tuiKey{name: "left"}
+			case 'H':
+				return i + 1, tuiKey{name: "home"}
+			case 'F':
+				return i + 1, tuiKey{name: "end"}
+			case 'Z':
+				return i + 1, tuiKey{name: "backtab"}
+			case '~':
+				switch params {
+				case "1", "7":
+					return i + 1, tuiKey{name: "home"}
+				case "4", "8":
+					return i + 1, tuiKey{name: "end"}
+				case "3":
+					return i + 1, tuiKey{name: "delete"}
+				case "5":
+					return i + 1, tuiKey{name: "pgup"}
+				case "6":
+					return i + 1, tuiKey{name: "pgdn"}
+				}
+			}
+			return i + 1, tuiKey{}
+		}
+		return 0, tuiKey{}
+	case c == '\r' || c == '\n':
+		return 1, tuiKey{name: "enter"}
+	case c == 0x7f || c == 0x08:
+		return 1, tuiKey{name: "backspace"}
+	case c == '\t':
+		return 1, tuiKey{name: "tab"}
+	case c < 0x20:
+		// Ctrl+letter
+		return 1, tuiKey{name: "ctrl-" + string(rune('a'+c-1))}
+	}
+	if !utf8.FullRune(b) {
+		return 0, tuiKey{}
+	}
+	r, n := utf8.DecodeRune(b)
+	if r == utf8.RuneError {
+		return n, tuiKey{}
+	}
+	return n, tuiKey{r: r}
+}
+
+func (t *tui) handleKey(key tuiKey) {
+	if key.r != 0 {
+		t.input = append(t.input[:t.cursor], append([]rune{key.r}, t.input[t.cursor:]...)...)
+		t.cursor++
+		return
+	}
+	switch key.name {
+	case "enter":
+		t.submit()
+	case "backspace", "ctrl-h":
+		if t.cursor > 0 {
+			t.input = append(t.input[:t.cursor-1], t.input[t.cursor:]...)
+			t.cursor--
+		}
+	case "delete":
+		if t.cursor < len(t.input) {
+			t.input = append(t.input[:t.cursor], t.input[t.cursor+1:]...)
+		}
+	case "left", "ctrl-b":
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case "right", "ctrl-f":
+		if t.cursor < len(t.input) {
+			t.cursor++
+		}
+	case "home", "ctrl-a":
+		t.cursor = 0
+	case "end", "ctrl-e":
+		t.cursor = len(t.input)
+	case "ctrl-k":
+		t.input = t.input[:t.cursor]
+	case "ctrl-u":
+		t.input = t.input[t.cursor:]
+		t.cursor = 0
+	case "ctrl-w":
+		start := t.cursor
+		for start > 0 && t.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && t.input[start-1] != ' ' {
+			start--
+		}
+		t.input = append(t.input[:start], t.input[t.cursor:]...)
+		t.cursor = start
+	case "up", "ctrl-p":
+		t.historyMove(-1)
+	case "down", "ctrl-n":
+		t.historyMove(1)
+	case "tab":
+		t.switchTo(t.cur + 1)
+	case "backtab":
+		t.switchTo(t.cur - 1)
+	case "pgup":
+		t.current().scroll += t.viewRows() - 1
+	case "pgdn":
+		c := t.current()
+		c.scroll = max(0, c.scroll-(t.viewRows()-1))
+	case "ctrl-c":
+		t.quit()
+	case "ctrl-d":
+		if len(t.input) == 0 {
+			t.quit()
+		}
+	}
+}
+
+// historyMove replaces the input with an earlier (-1) or later (1) line of
+// the history, keeping the line being typed at its end.
+func (t *tui) historyMove(delta int) {
+	pos := t.histPos + delta
+	if pos < 0 || pos > len(t.history) {
+		return
+	}
+	if t.histPos == len(t.history) {
+		t.draft = append([]rune(nil), t.input...)
+	}
+	t.histPos = pos
+	if pos == len(t.history) {
+		t.input = t.draft
+	} else {
+		t.input = []rune(t.history[pos])
+	}
+	t.cursor = len(t.input)
+}
+
+func (t *tui) submit() {
+	line := string(t.input)
+	t.input, t.cursor, t.draft = nil, 0, nil
+	if strings.TrimSpace(line) == "" {
+		t.histPos = len(t.history)
+		return
+	}
+	if len(t.history) == 0 || t.history[len(t.history)-1] != line {
+		t.history = append(t.history, line)
+	}
+	t.histPos = len(t.history)
+	if strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//") {
+		t.command(strings.Fields(line))
+		return
+	}
+	t.send(strings.TrimPrefix(line, "/"))
+}
+
+func (t *tui) command(args []string) {
+	switch args[0] {
+	case "/to":
+		if len(args) != 2 {
+			t.notice("Usage: /to NAME")
+			return
+		}
+		t.switchTo(t.open(args[1]))
+	case "/close":
+		if len(t.convs) == 0 {
+			return
+		}
+		t.convs = append(t.convs[:t.cur], t.convs[t.cur+1:]...)
+		t.switchTo(t.cur)
+	case "/peers":
+		var names []string
+		for name := range t.online {
+			if name != t.node.Name {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			t.notice("Nobody else is online")
+			return
+		}
+		t.notice("Online: " + strings.Join(names, ", "))
+	case "/help":
+		t.notice(tuiHelp)
+	case "/quit":
+		t.quit()
+	default:
+		t.notice(fmt.Sprintf("Unknown command %s: try /help", args[0]))
+	}
+}
+
+// send queues text for the session, to the current conversation.
+func (t *tui) send(text string) {
+	if len(t.convs) == 0 {
+		t.notice("No peer to send to: open a conversation with /to NAME")
+		return
+	}
+	if t.quitting {
+		t.notice("Not sent: leaving")
+		return
+	}
+	c := t.convs[t.cur]
+	t.pending = append(t.pending, []byte(c.name+"<"+text+"\n"))
+	c.add(tuiLine{kind: lineSent, from: t.node.Name, text: text})
+	c.scroll = 0
+}
+
+// receive shows a 'SENDER>message' line of the session.
+func (t *tui) receive(line []byte) {
+	appMsg, err := msgspec.DecodeApplicationMsg([]byte(strings.TrimSuffix(string(line), "\n")))
+	if err != nil {
+		t.notice(err.Error())
+		return
+	}
+	name, from := appMsg.Name, appMsg.Name
+	if group, sender, ok := strings.Cut(appMsg.Name, "/"); ok && rpipe.IsGroup(group) {
+		name, from = group, sender
+	}
+	i := t.open(name)
+	t.convs[i].add(tuiLine{kind: lineReceived, from: from, text: string(appMsg.Data)})
+	if i != t.cur {
+		t.convs[i].unread++
+	}
+}
+
+func (t *tui) presenceChanged(event rpipe.PresenceEvent) {
+	name := event.Peer.Name
+	t.online[name] = event.Event == rpipe.PresenceJoin
+	for _, c := range t.convs {
+		if c.name != name {
+			continue
+		}
+		if event.Event == rpipe.PresenceJoin {
+			c.add(tuiLine{kind: lineSystem, text: name + " joined from " + event.Peer.Host})
+		} else {
+			c.add(tuiLine{kind: lineSystem, text: name + " left"})
+		}
+	}
+}
+
+// quit stops input; the session drains and closes out, which ends run.
+func (t *tui) quit() {
+	if !t.quitting {
+		t.quitting = true
+		t.notice("Leaving...")
+	}
+	t.closeInput()
+}
+
+// closeInput closes in once quitting and every line has been sent.
+func (t *tui) closeInput() {
+	if t.quitting && len(t.pending) == 0 && !t.inClosed {
+		t.inClosed = true
+		close(t.in)
+	}
+}
+
+// open returns the index of the conversation with name, adding it if
+// needed.
+func (t *tui) open(name string) int {
+	for i, c := range t.convs {
+		if c.name == name {
+			return i
+		}
+	}
+	t.convs = append(t.convs, &conversation{name: name})
+	return len(t.convs) - 1
+}
+
+func (t *tui) switchTo(i int) {
+	if len(t.convs) == 0 {
+		t.cur = 0
+		return
+	}
+	t.cur = (i + len(t.convs)) % len(t.convs)
+	t.convs[t.cur].unread = 0
+}
+
+// current returns the conversation on screen.
+func (t *tui) current() *conversation {
+	if len(t.convs) == 0 {
+		return t.notices
+	}
+	return t.convs[t.cur]
+}
+
+func (t *tui) notice(text string) {
+	t.current().add(tuiLine{kind: lineSystem, text: text})
+}
+
+// viewRows is the height of the scrollback, between the tab bar and the
+// status and input lines.
+func (t *tui) viewRows() int {
+	return max(1, t.height-3)
+}
+
+func (t *tui) render() {
+	var b strings.Builder
+	b.WriteString("\x1b[?25l\x1b[1;1H")
+	b.WriteString(t.tabBar())
+	b.WriteString(styleReset + "\x1b[K")
+
+	rows := t.viewRows()
+	c := t.current()
+	all := t.wrapLines(c)
+	c.scroll = min(c.scroll, max(0, len(all)-rows))
+	end := len(all) - c.scroll
+	start := max(0, end-rows)
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", i+2)
+		if start+i < end {
+			b.WriteString(all[start+i])
+		}
+		b.WriteString(styleReset + "\x1b[K")
+	}
+
+	fmt.Fprintf(&b, "\x1b[%d;1H%s%s\x1b[K%s", rows+2, styleReverse, t.statusLine(), styleReset)
+
+	prompt := "> "
+	if len(t.convs) > 0 {
+		prompt = sanitize(t.convs[t.cur].name) + "< "
+	}
+	prompt = truncate(prompt, t.width/2)
+	visible, col := t.inputView(t.width - textWidth(prompt) - 1)
+	fmt.Fprintf(&b, "\x1b[%d;1H%s%s%s%s\x1b[K", rows+3, styleBold, prompt, styleReset, visible)
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", rows+3, textWidth(prompt)+col+1)
+	_, _ = os.Stdout.WriteString(b.String())
+}
+
+// tabBar lists the conversations, the current one highlighted, scrolled
+// so that it shows.
+func (t *tui) tabBar() string {
+	if len(t.convs) == 0 {
+		return styleDim + " no conversation: /to NAME" + styleReset
+	}
+	tabs := make([]string, len(t.convs))
+	widths := make([]int, len(t.convs))
+	for i, c := range t.convs {
+		label := " " + sanitize(c.name)
+		if c.unread > 0 {
+			label += fmt.Sprintf(" (%d)", c.unread)
+		}
+		label += " "
+		widths[i] = textWidth(label) + 2
+		mark := "  "
+		if !rpipe.IsGroup(c.name) {
+			mark = styleDim + " ○" + styleReset
+			if t.online[c.name] {
+				mark = styleOnline + " ●" + styleReset
+			}
+		}
+		if i == t.cur {
+			label = styleReverse + label + styleReset
+		} else if c.unread > 0 {
+			label = styleBold + label + styleReset
+		}
+		tabs[i] = mark + label
+	}
+	first, width := 0, 0
+	for i := t.cur; i >= 0; i-- {
+		if width+widths[i] > t.width && i != t.cur {
+			break
+		}
+		width += widths[i]
+		first = i
+	}
+	var b strings.Builder
+	width = 0
+	for i := first; i < len(tabs) && width+widths[i] <= t.width; i++ {
+		b.WriteString(tabs[i])
+		width += widths[i]
+	}
+	return b.String()
+}
+
+func (t *tui) statusLine() string {
+	status := " " + t.node.Name
+	if len(t.convs) > 0 {
+		name := t.convs[t.cur].name
+		status += " → " + sanitize(name)
+		if !rpipe.IsGroup(name) {
+			if t.online[name] {
+				status += " (online)"
+			} else {
+				status += " (offline)"
+			}
+		}
+	}
+	if t.current().scroll > 0 {
+		status += "  [scrolled up: PgDn]"
+	}
+	hint := "Tab: next peer  /help "
+	if pad := t.width - textWidth(status) - textWidth(hint); pad > 0 {
+		status += strings.Repeat(" ", pad) + hint
+	}
+	return truncate(status, t.width)
+}
+
+// wrapLines renders the lines of c as screen rows.
+func (t *tui) wrapLines(c *conversation) []string {
+	var rows []string
+	for _, line := range c.lines {
+		prefix := line.time.Format("15:04") + " "
+		style := styleDim
+		switch line.kind {
+		case lineSent:
+			prefix += sanitize(line.from) + "> "
+			style = styleSent
+		case lineReceived:
+			prefix += sanitize(line.from) + "> "
+			style = ""
+		default:
+			prefix += "-- "
+		}
+		indent := strings.Repeat(" ", textWidth(prefix))
+		for i, part := range wrapText(sanitize(line.text), max(1, t.width-len(indent))) {
+			head := indent
+			if i == 0 {
+				head = prefix
+				if line.kind == lineReceived {
+					head = prefix[:6] + styleReceived + prefix[6:] + styleReset
+				}
+			}
+			rows = append(rows, style+head+part+styleReset)
+		}
+	}
+	return rows
+}
+
+// inputView returns the part of the input that fits in width, scrolled so
+// that the cursor shows, and the cursor's column in it.
+func (t *tui) inputView(width int) (string, int) {
+	width = max(1, width)
+	t.inputOffset = min(t.inputOffset, t.cursor)
+	for textWidth(string(t.input[t.inputOffset:t.cursor])) > width {
+		t.inputOffset++
+	}
+	var b strings.Builder
+	w := 0
+	for _, r := range t.input[t.inputOffset:] {
+		rw := runeWidth(r)
+		if w+rw > width {
+			break
+		}
+		b.WriteString(sanitize(string(r)))
+		w += rw
+	}
+	return b.String(), textWidth(string(t.input[t.inputOffset:t.cursor]))
+}
+
+// sanitize replaces control characters, which could move the cursor or
+// change the terminal, and tabs.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0):
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// runeWidth returns the columns r takes: 2 for wide East Asian characters
+// and emoji, 1 otherwise.
+func runeWidth(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+func textWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+// truncate cuts s to width columns.
+func truncate(s string, width int) string {
+	w := 0
+	for i, r := range s {
+		w += runeWidth(r)
+		if w > width {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// wrapText splits s into rows of at most width columns, after a space
+// where there is one.
+func wrapText(s string, width int) []string {
+	var rows []string
+	for {
+		row := truncate(s, width)
+		if row == s {
+			return append(rows, s)
+		}
+		if i := strings.LastIndexByte(row, ' '); i > 0 {
+			row = row[:i+1]
+		} else if row == "" {
+			// a wide character in a single column
+			_, n := utf8.DecodeRuneInString(s)
+			row = s[:n]
+		}
+		rows = append(rows, row)
+		s = s[len(row):]
+		if s == "" {
+			return rows
+		}
+	}
+}
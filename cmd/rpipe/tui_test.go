@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in    string
+		wantN int
+		want  tuiKey
+	}{
+		{"a", 1, tuiKey{r: 'a'}},
+		{"ab", 1, tuiKey{r: 'a'}},
+		{"한", 3, tuiKey{r: '한'}},
+		{"\r", 1, tuiKey{name: "enter"}},
+		{"\x7f", 1, tuiKey{name: "backspace"}},
+		{"\t", 1, tuiKey{name: "tab"}},
+		{"\x01", 1, tuiKey{name: "ctrl-a"}},
+		{"\x1b[A", 3, tuiKey{name: "up"}},
+		{"\x1bOB", 3, tuiKey{name: "down"}},
+		{"\x1b[Zx", 3, tuiKey{name: "backtab"}},
+		{"\x1b[3~", 4, tuiKey{name: "delete"}},
+		{"\x1b[5~", 4, tuiKey{name: "pgup"}},
+		{"\x1b[1;5C", 6, tuiKey{name: "right"}},
+		{"\x1b[99~", 5, tuiKey{}},
+		{"\x1bx", 2, tuiKey{}},
+		{"\xff", 1, tuiKey{}},
+		// unfinished
+		{"\x1b", 0, tuiKey{}},
+		{"\x1b[", 0, tuiKey{}},
+		{"\x1b[1;5", 0, tuiKey{}},
+		{"\x1bO", 0, tuiKey{}},
+		{"\xed\x95", 0, tuiKey{}},
+	}
+	for _, tt := range tests {
+		n, key := parseKey([]byte(tt.in))
+		if n != tt.wantN || key != tt.want {
+			t.Errorf("parseKey(%q) = %d, %+v, want %d, %+v", tt.in, n, key, tt.wantN, tt.want)
+		}
+	}
+}
+
+func TestFeedKeys_Split(t *testing.T) {
+	tests := []struct {
+		chunks    []string
+		wantInput string
+		wantCur   int
+		waiting   bool
+	}{
+		{[]string{"ab"}, "ab", 2, false},
+		{[]string{"ab\x1b", "[D"}, "ab", 1, false},
+		{[]string{"ab\x1b[", "D"}, "ab", 1, false},
+		{[]string{"abc\x1b[1;5", "D\x1b[", "D"}, "abc", 1, false},
+		{[]string{"\xed", "\x95\x9c", "\xea\xb8", "\x80"}, "한글", 2, false},
+		{[]string{"a\x1b"}, "a", 1, true},
+		{[]string{"a\x1b["}, "a", 1, true},
+		{[]string{"a\xed\x95"}, "a", 1, false},
+	}
+	for _, tt := range tests {
+		tu := &tui{}
+		var waiting bool
+		for _, chunk := range tt.chunks {
+			waiting = tu.feedKeys([]byte(chunk))
+		}
+		if string(tu.input) != tt.wantInput || tu.cursor != tt.wantCur || waiting != tt.waiting {
+			t.Errorf("%q: input %q, cursor %d, waiting %t, want %q, %d, %t", tt.chunks, string(tu.input), tu.cursor, waiting, tt.wantInput, tt.wantCur, tt.waiting)
+		}
+	}
+}
+
+func TestFeedKeys_Overlong(t *testing.T) {
+	tu := &tui{}
+	if tu.feedKeys([]byte("\x1b[" + strings.Repeat("1", maxKeyLen))) {
+		t.Error("an overlong sequence is still waiting")
+	}
+	tu.feedKeys([]byte("a"))
+	if string(tu.input) != "a" {
+		t.Errorf("input %q after an overlong sequence, want \"a\"", string(tu.input))
+	}
+}
+
+func TestFlushKeys(t *testing.T) {
+	tu := &tui{}
+	tu.feedKeys([]byte("a\x1b["))
+	tu.flushKeys()
+	tu.feedKeys([]byte("D"))
+	if string(tu.input) != "aD" || tu.cursor != 2 {
+		t.Errorf("input %q, cursor %d, want \"aD\", 2", string(tu.input), tu.cursor)
+	}
+}
+
+func TestHistoryMove(t *testing.T) {
+	tu := &tui{history: []string{"one", "two"}, histPos: 2, input: []rune("draft"), cursor: 1}
+	steps := []struct {
+		delta int
+		want  string
+	}{
+		{-1, "two"},
+		{-1, "one"},
+		{-1, "one"},
+		{1, "two"},
+		{1, "draft"},
+		{1, "draft"},
+	}
+	for i, step := range steps {
+		tu.historyMove(step.delta)
+		if string(tu.input) != step.want || tu.cursor != len(tu.input) {
+			t.Errorf("step %d: input %q, cursor %d, want %q at its end", i, string(tu.input), tu.cursor, step.want)
+		}
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"한글", 4},
+		{"a한b", 4},
+		{"日本", 4},
+		{"😀", 2},
+		{"é", 1},
+	}
+	for _, tt := range tests {
+		if got := textWidth(tt.in); got != tt.want {
+			t.Errorf("textWidth(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		want  string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"hello", 0, ""},
+		{"한글", 4, "한글"},
+		{"한글", 3, "한"},
+		{"한글", 1, ""},
+		{"a한", 2, "a"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.in, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		want  []string
+	}{
+		{"", 5, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"hello world", 8, []string{"hello ", "world"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"한글한글", 5, []string{"한글", "한글"}},
+		{"한글", 1, []string{"한", "글"}},
+	}
+	for _, tt := range tests {
+		if got := wrapText(tt.in, tt.width); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", tt.in, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"a\tb", "a b"},
+		{"\x1b[2Jgone", "?[2Jgone"},
+		{"bell\x07", "bell?"},
+		{"del\x7f", "del?"},
+		{"c1\u009b", "c1?"},
+		{"한글 é", "한글 é"},
+	}
+	for _, tt := range tests {
+		if got := sanitize(tt.in); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTUILogWriter(t *testing.T) {
+	w := newTUILogWriter()
+	for i := 0; i < tuiLogBacklog+3; i++ {
+		fmt.Fprintf(w, "entry %d\n", i)
+	}
+	select {
+	case <-w.wake:
+	default:
+		t.Fatal("no wake-up after a write")
+	}
+	lines, dropped := w.take()
+	if len(lines) != tuiLogBacklog || lines[0] != "entry 0" || dropped != 3 {
+		t.Errorf("got %d lines starting %q, %d dropped, want %d, \"entry 0\", 3", len(lines), lines[0], dropped, tuiLogBacklog)
+	}
+	if lines, dropped := w.take(); len(lines) != 0 || dropped != 0 {
+		t.Errorf("second take: %d lines, %d dropped", len(lines), dropped)
+	}
+}
@@ -0,0 +1,122 @@
+package rpipe
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"time"
+)
+
+const (
+	DefaultRetryWindow  = 30 * time.Second
+	DefaultPingInterval = 5 * time.Second
+
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+// Connected reports whether the last connection check succeeded.
+func (n *Node) Connected() bool {
+	return n.connected.Load()
+}
+
+func (n *Node) addPeer(name string) {
+	if name == "" || name == n.Name || msgspec.IsGroup(name) {
+		return
+	}
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	n.peers[name] = true
+}
+
+func (n *Node) knownPeers() []string {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	var peers []string
+	for peer := range n.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// watchConnection checks Redis and refreshes the presence record every
+// PingInterval. The go-redis pub/sub connection resubscribes on its own,
+// but a restarted Redis may have lost our pubkey and symkeys, so they are
+// re-established when the connection comes back or the pubkey is found
+// missing.
+func (n *Node) watchConnection() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.PingInterval)
+	defer ticker.Stop()
+	var lostAt time.Time
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		registered, err := n.crypto.PubkeyRegistered(n.ctx, n.Name)
+		if n.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if n.connected.Swap(false) {
+				lostAt = time.Now()
+				log.Warningln("Redis connection lost", err)
+			}
+			continue
+		}
+		if !n.connected.Load() {
+			log.Infof("Redis connection restored after %s", time.Since(lostAt).Round(time.Millisecond))
+		} else if !registered {
+			log.Warningln("Pubkey missing from Redis, re-registering")
+		} else {
+			err := n.refreshPresence(false)
+			if err != nil {
+				log.Warningln("Failed to refresh presence", err)
+			}
+			continue
+		}
+		n.connected.Store(n.resume())
+	}
+}
+
+// resume re-registers the pubkey and asks every known peer to renegotiate
+// symkeys in both directions. It reports whether that succeeded.
+func (n *Node) resume() bool {
+	n.crypto.ClearSymkeys()
+	err := n.crypto.RegisterPubkey(n.ctx, n.Name)
+	if err != nil {
+		log.Warningln("Failed to re-register pubkey", err)
+		return false
+	}
+	err = n.rejoinGroups()
+	if err != nil {
+		log.Warningln("Failed to rejoin groups", err)
+		return false
+	}
+	err = n.reregisterPatterns()
+	if err != nil {
+		log.Warningln("Failed to re-register patterns", err)
+		return false
+	}
+	err = n.rejoinQueues()
+	if err != nil {
+		log.Warningln("Failed to rejoin queues", err)
+		return false
+	}
+	err = n.refreshPresence(false)
+	if err != nil {
+		log.Warningln("Failed to refresh presence", err)
+		return false
+	}
+	for _, peer := range n.knownPeers() {
+		resetMsg := msgspec.RpipeMsg{From: n.Name, To: peer, Control: msgspec.ControlResetSymkey}
+		err := n.rdb.Publish(n.ctx, peer, resetMsg.Marshal()).Err()
+		if err != nil {
+			log.Warningln("Failed to publish SYMKEYS reset to "+peer, err)
+			return false
+		}
+	}
+	log.Infoln("Session resumed: pubkey registered and symkeys reset")
+	return true
+}
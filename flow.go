@@ -0,0 +1,69 @@
+package rpipe
+
+import "github.com/sng2c/rpipe/msgspec"
+
+// Pipe mode flow control is credit based: the receiver acks the total
+// number of bytes it has written out, and the sender stops reading local
+// input while more than its window is unacknowledged. This keeps the Redis
+// subscriber output buffer of a slow receiver bounded.
+const (
+	DefaultWindow = 8 * 1024 * 1024
+	// ackInterval is how many consumed bytes the receiver batches per ack.
+	ackInterval = 64 * 1024
+	minWindow   = 2 * ackInterval
+)
+
+type sendWindow struct {
+	size  int64
+	sent  int64
+	acked int64
+}
+
+func newSendWindow(size int) *sendWindow {
+	if size > 0 && size < minWindow {
+		size = minWindow
+	}
+	return &sendWindow{size: int64(size)}
+}
+
+// exhausted reports whether the sender must wait for an ack.
+func (w *sendWindow) exhausted() bool {
+	return w.size > 0 && w.sent-w.acked >= w.size
+}
+
+func (w *sendWindow) onSent(n int) {
+	w.sent += int64(n)
+}
+
+func (w *sendWindow) onAck(consumed int64) {
+	if consumed > w.acked {
+		w.acked = consumed
+	}
+}
+
+type recvWindow struct {
+	consumed int64
+	acked    int64
+}
+
+// onConsumed records n bytes written out and reports whether an ack with
+// the returned total is due.
+func (w *recvWindow) onConsumed(n int) (int64, bool) {
+	w.consumed += int64(n)
+	if w.consumed-w.acked < ackInterval {
+		return 0, false
+	}
+	w.acked = w.consumed
+	return w.consumed, true
+}
+
+// SendAck tells the channel to how many bytes of its pipe data were consumed.
+func (n *Node) SendAck(to string, consumed int64) error {
+	return n.Publish(&msgspec.RpipeMsg{To: to, Control: msgspec.ControlAck, Ack: consumed})
+}
+
+// ackFor acknowledges pipe data received in msg from the channel it was
+// sent to, which differs from the node name for pattern subscriptions.
+func (n *Node) ackFor(msg *msgspec.RpipeMsg, consumed int64) error {
+	return n.Publish(&msgspec.RpipeMsg{From: msg.To, To: msg.From, Control: msgspec.ControlAck, Ack: consumed})
+}
@@ -0,0 +1,48 @@
+package rpipe
+
+import "testing"
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow(minWindow)
+	w.onSent(minWindow - 1)
+	if w.exhausted() {
+		t.Fatal("window exhausted too early")
+	}
+	w.onSent(1)
+	if !w.exhausted() {
+		t.Fatal("expected window to be exhausted")
+	}
+	w.onAck(ackInterval)
+	if w.exhausted() {
+		t.Fatal("ack should reopen the window")
+	}
+	w.onAck(1) // stale ack
+	if w.acked != ackInterval {
+		t.Fatalf("stale ack moved acked back to %d", w.acked)
+	}
+}
+
+func TestSendWindow_Disabled(t *testing.T) {
+	w := newSendWindow(0)
+	w.onSent(1 << 30)
+	if w.exhausted() {
+		t.Fatal("a zero window never blocks")
+	}
+	if newSendWindow(1).size != minWindow {
+		t.Fatal("small windows are raised to minWindow")
+	}
+}
+
+func TestRecvWindow(t *testing.T) {
+	var w recvWindow
+	if _, due := w.onConsumed(ackInterval - 1); due {
+		t.Fatal("ack due too early")
+	}
+	ack, due := w.onConsumed(10)
+	if !due || ack != ackInterval+9 {
+		t.Fatalf("want ack %d, got %d (due %v)", ackInterval+9, ack, due)
+	}
+	if _, due := w.onConsumed(1); due {
+		t.Fatal("ack due right after an ack")
+	}
+}
@@ -0,0 +1,349 @@
+package rpipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRemoteForwardRefused = errors.New("remote forward refused")
+
+// ForwardSpec is one port forward: connections accepted on Listen are
+// relayed to Dest, dialled on the other side of the forward.
+type ForwardSpec struct {
+	Listen string `json:"listen"`
+	Dest   string `json:"dest"`
+}
+
+// ParseForwardSpec parses the ssh style [bind_address:]port:host:hostport.
+// IPv6 addresses are written in brackets. The bind address defaults to
+// localhost.
+func ParseForwardSpec(s string) (ForwardSpec, error) {
+	var parts []string
+	for {
+		var part string
+		if strings.HasPrefix(s, "[") {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return ForwardSpec{}, errors.New("invalid forward: unclosed '['")
+			}
+			part, s = s[1:end], s[end+1:]
+		} else {
+			end := strings.IndexByte(s, ':')
+			if end < 0 {
+				end = len(s)
+			}
+			part, s = s[:end], s[end:]
+		}
+		parts = append(parts, part)
+		if s == "" {
+			break
+		}
+		if s[0] != ':' {
+			return ForwardSpec{}, errors.New("invalid forward: expected ':' after ']'")
+		}
+		s = s[1:]
+	}
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+	default:
+		return ForwardSpec{}, errors.New("invalid forward: expected [bind_address:]port:host:hostport")
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ForwardSpec{}, errors.New("invalid forward: empty field in [bind_address:]port:host:hostport")
+		}
+	}
+	return ForwardSpec{
+		Listen: net.JoinHostPort(parts[0], parts[1]),
+		Dest:   net.JoinHostPort(parts[2], parts[3]),
+	}, nil
+}
+
+func (f ForwardSpec) String() string {
+	return f.Listen + " -> " + f.Dest
+}
+
+type ForwarderOptions struct {
+	// Target is the peer that forwarded connections are relayed through.
+	Target string
+	// Window is the per-connection flow control window in bytes. Zero uses
+	// DefaultWindow.
+	Window int
+	// Allow restricts the destinations the peer may have this side dial.
+	// Nil allows any destination. The destinations of RequestRemote are
+	// always allowed.
+	Allow AllowList
+	// AllowRemoteListen lets the peer have this side listen for its remote
+	// forwards, on loopback addresses and RemoteBinds only.
+	AllowRemoteListen bool
+	// RemoteBinds lists the other bind addresses, such as 0.0.0.0, that
+	// remote forwards may use.
+	RemoteBinds []string
+}
+
+// Forwarder relays TCP connections through a Mux to one peer. Each
+// connection is a stream labelled with the destination the peer dials.
+type Forwarder struct {
+	node *Node
+	opts ForwarderOptions
+	mux  *Mux
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	// requests are the remote forwards awaiting an answer, by Cid
+	requests    map[string]chan error
+	remoteDests []string
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewForwarder creates a forwarder between node and opts.Target.
+func NewForwarder(node *Node, opts ForwarderOptions) *Forwarder {
+	f := &Forwarder{
+		node:     node,
+		opts:     opts,
+		requests: make(map[string]chan error),
+	}
+	f.mux = NewMux(node, MuxOptions{
+		Target:    opts.Target,
+		Window:    opts.Window,
+		OnStream:  f.dial,
+		OnMessage: f.handleMessage,
+	})
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	return f
+}
+
+// ListenLocal accepts connections on spec.Listen and has the peer dial
+// spec.Dest for each of them (ssh -L).
+func (f *Forwarder) ListenLocal(spec ForwardSpec) error {
+	ln, err := f.listen(spec.Listen)
+	if err != nil {
+		return err
+	}
+	log.Infof("Forwarding %s via %s", spec, f.opts.Target)
+	go f.acceptLoop(ln, func(conn net.Conn) {
+		st, err := f.mux.Open(spec.Dest)
+		if err != nil {
+			log.Warningln("Failed to open stream", err)
+			_ = conn.Close()
+			return
+		}
+		log.Debugf("%s: accepted %s", st, conn.RemoteAddr())
+		relay(conn, st)
+	})
+	return nil
+}
+
+// RequestRemote asks the peer to accept connections on spec.Listen and
+// have this side dial spec.Dest for each of them (ssh -R). The returned
+// channel receives the answer while Run runs: nil once the peer listens,
+// or an ErrRemoteForwardRefused.
+func (f *Forwarder) RequestRemote(spec ForwardSpec) (<-chan error, error) {
+	data, _ := json.Marshal(spec)
+	cid := NewCallID()
+	result := make(chan error, 1)
+	f.mu.Lock()
+	f.requests[cid] = result
+	f.remoteDests = append(f.remoteDests, spec.Dest)
+	f.mu.Unlock()
+	log.Infof("Requesting remote forward %s from %s", spec, f.opts.Target)
+	err := f.node.Publish(&msgspec.RpipeMsg{To: f.opts.Target, Control: msgspec.ControlForwardListen, Cid: cid, Data: data})
+	if err != nil {
+		f.mu.Lock()
+		delete(f.requests, cid)
+		f.mu.Unlock()
+		return nil, err
+	}
+	return result, nil
+}
+
+// Run relays until ctx is cancelled or the node is closed, then closes all
+// listeners and connections.
+func (f *Forwarder) Run(ctx context.Context) error {
+	defer f.shutdown()
+	return f.mux.Run(ctx)
+}
+
+func (f *Forwarder) shutdown() {
+	f.cancel()
+	f.mu.Lock()
+	listeners := f.listeners
+	f.mu.Unlock()
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+}
+
+func (f *Forwarder) handleMessage(msg *msgspec.RpipeMsg) {
+	switch msg.Control {
+	case msgspec.ControlForwardListen:
+		err := f.listenRemote(msg.Data)
+		if err != nil {
+			log.Warningln("Refused remote forward", err)
+		}
+		var reason []byte
+		if err != nil {
+			reason = []byte(err.Error())
+		}
+		err = f.node.Publish(&msgspec.RpipeMsg{To: msg.From, Control: msgspec.ControlForwardResult, Cid: msg.Cid, Data: reason})
+		if err != nil {
+			log.Warningln("Failed to answer remote forward request", err)
+		}
+	case msgspec.ControlForwardResult:
+		f.mu.Lock()
+		result, ok := f.requests[msg.Cid]
+		delete(f.requests, msg.Cid)
+		f.mu.Unlock()
+		if !ok {
+			return
+		}
+		if len(msg.Data) > 0 {
+			result <- fmt.Errorf("%w: %s", ErrRemoteForwardRefused, msg.Data)
+		} else {
+			result <- nil
+		}
+	}
+}
+
+// listenRemote listens for the peer's remote forward, if allowed.
+func (f *Forwarder) listenRemote(data []byte) error {
+	var spec ForwardSpec
+	err := json.Unmarshal(data, &spec)
+	if err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	err = f.checkRemoteListen(spec.Listen)
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec, err)
+	}
+	// The requester dials Dest, so the streams we open carry it.
+	err = f.ListenLocal(spec)
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec, err)
+	}
+	return nil
+}
+
+// checkRemoteListen reports why the peer may not have this side listen on
+// addr, if it may not.
+func (f *Forwarder) checkRemoteListen(addr string) error {
+	if !f.opts.AllowRemoteListen {
+		return errors.New("remote listens are not allowed here")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	for _, bind := range f.opts.RemoteBinds {
+		if host == bind {
+			return nil
+		}
+	}
+	return fmt.Errorf("bind address '%s' is not allowed here", host)
+}
+
+func (f *Forwarder) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.listeners = append(f.listeners, ln)
+	f.mu.Unlock()
+	return ln, nil
+}
+
+func (f *Forwarder) acceptLoop(ln net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if f.ctx.Err() == nil {
+				log.Warningln("Accept failed", err)
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// dial connects a stream opened by the peer to its destination.
+func (f *Forwarder) dial(st *Stream) {
+	if f.opts.Allow != nil && !f.opts.Allow.Permits(st.Label) && !f.requested(st.Label) {
+		log.Warningf("%s: destination not allowed", st)
+		_ = st.Reset(resetNotAllowed)
+		return
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(f.ctx, "tcp", st.Label)
+	if err != nil {
+		log.Warningf("%s: dial failed: %v", st, err)
+		_ = st.Reset(err.Error())
+		return
+	}
+	log.Debugf("%s: connected", st)
+	err = st.Accept()
+	if err != nil {
+		log.Warningf("%s: failed to accept: %v", st, err)
+		_ = conn.Close()
+		_ = st.Reset(err.Error())
+		return
+	}
+	relay(conn, st)
+}
+
+// requested reports whether dest is the destination of a remote forward
+// this side asked for.
+func (f *Forwarder) requested(dest string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.remoteDests {
+		if d == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// relay copies between conn and st in both directions, passing half
+// closes through. An error on either side resets the stream.
+func relay(conn net.Conn, st *Stream) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(conn, st)
+		if err != nil {
+			_ = st.Reset(err.Error())
+			_ = conn.Close()
+			return
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+	_, err := io.Copy(st, conn)
+	if err != nil {
+		_ = st.Reset(err.Error())
+		_ = conn.Close()
+	} else {
+		_ = st.CloseWrite()
+	}
+	<-done
+	_ = conn.Close()
+	_ = st.Close()
+	log.Debugf("%s closed", st)
+}
@@ -0,0 +1,54 @@
+package rpipe
+
+import "testing"
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ForwardSpec
+	}{
+		{"5432:db.internal:5432", ForwardSpec{Listen: "localhost:5432", Dest: "db.internal:5432"}},
+		{"0.0.0.0:8080:localhost:80", ForwardSpec{Listen: "0.0.0.0:8080", Dest: "localhost:80"}},
+		{"[::1]:8080:[2001:db8::1]:80", ForwardSpec{Listen: "[::1]:8080", Dest: "[2001:db8::1]:80"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseForwardSpec(tt.in)
+		if err != nil {
+			t.Errorf("ParseForwardSpec(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseForwardSpec(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "5432", "5432:db", "5432:db:", "a:b:c:d:e", "[::1:80:db:5432", "[::1]x:80:db:5432"} {
+		if _, err := ParseForwardSpec(in); err == nil {
+			t.Errorf("ParseForwardSpec(%q): expected error", in)
+		}
+	}
+}
+
+func TestForwarder_CheckRemoteListen(t *testing.T) {
+	tests := []struct {
+		opts    ForwarderOptions
+		addr    string
+		allowed bool
+	}{
+		{ForwarderOptions{}, "localhost:8080", false},
+		{ForwarderOptions{AllowRemoteListen: true}, "localhost:8080", true},
+		{ForwarderOptions{AllowRemoteListen: true}, "127.0.0.1:8080", true},
+		{ForwarderOptions{AllowRemoteListen: true}, "[::1]:8080", true},
+		{ForwarderOptions{AllowRemoteListen: true}, "0.0.0.0:8080", false},
+		{ForwarderOptions{AllowRemoteListen: true}, ":8080", false},
+		{ForwarderOptions{AllowRemoteListen: true, RemoteBinds: []string{"0.0.0.0"}}, "0.0.0.0:8080", true},
+		{ForwarderOptions{AllowRemoteListen: true, RemoteBinds: []string{"0.0.0.0"}}, "10.0.0.1:8080", false},
+	}
+	for _, tt := range tests {
+		f := &Forwarder{opts: tt.opts}
+		err := f.checkRemoteListen(tt.addr)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkRemoteListen(%q) with %+v = %v, want allowed %v", tt.addr, tt.opts, err, tt.allowed)
+		}
+	}
+}
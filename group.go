@@ -0,0 +1,123 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"github.com/sng2c/rpipe/secure"
+	"sort"
+)
+
+var ErrGroupsUnsupported = errors.New("crypto does not support groups")
+
+// GroupCrypto is implemented by Crypto implementations that support group
+// channels such as '@ops'. Membership changes re-key the group, so only
+// current members can read what is sent after them.
+type GroupCrypto interface {
+	JoinGroup(ctx context.Context, group, member string) error
+	LeaveGroup(ctx context.Context, group, member string) error
+}
+
+// JoinGroup adds this node to group and subscribes to its channel. A
+// single Send to the group then reaches every member.
+func (n *Node) JoinGroup(group string) error {
+	if !msgspec.IsGroup(group) {
+		return fmt.Errorf("invalid group name '%s': must start with '@'", group)
+	}
+	gc, ok := n.crypto.(GroupCrypto)
+	if !ok {
+		return ErrGroupsUnsupported
+	}
+	err := gc.JoinGroup(n.ctx, group, n.Name)
+	if err != nil {
+		return fmt.Errorf("join %s: %w", group, err)
+	}
+	err = n.pubsub.Subscribe(n.ctx, group)
+	if err != nil {
+		return err
+	}
+	n.peersMu.Lock()
+	n.groups[group] = true
+	n.peersMu.Unlock()
+	log.Debugf("Joined %s", group)
+	return nil
+}
+
+// LeaveGroup unsubscribes from group and removes this node from it.
+func (n *Node) LeaveGroup(group string) error {
+	return n.leaveGroup(n.ctx, group)
+}
+
+func (n *Node) leaveGroup(ctx context.Context, group string) error {
+	gc, ok := n.crypto.(GroupCrypto)
+	if !ok {
+		return ErrGroupsUnsupported
+	}
+	n.peersMu.Lock()
+	delete(n.groups, group)
+	n.peersMu.Unlock()
+	err := n.pubsub.Unsubscribe(ctx, group)
+	if err != nil {
+		return err
+	}
+	return gc.LeaveGroup(ctx, group, n.Name)
+}
+
+// Groups returns the groups this node has joined.
+func (n *Node) Groups() []string {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	var groups []string
+	for group := range n.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func (n *Node) inGroup(group string) bool {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	return n.groups[group]
+}
+
+// GroupMembers returns the members of group recorded in Redis.
+func (n *Node) GroupMembers(group string) ([]string, error) {
+	return secure.GroupMembers(n.ctx, n.rdb, group)
+}
+
+// leaveGroups leaves every joined group, so the others are re-keyed
+// without this node.
+func (n *Node) leaveGroups() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	for _, group := range n.Groups() {
+		err := n.leaveGroup(ctx, group)
+		if err != nil {
+			log.Warningf("Failed to leave %s: %v", group, err)
+		}
+	}
+}
+
+// rejoinGroups joins every group again after a reconnect, in case Redis
+// lost the membership or the wrapped group keys.
+func (n *Node) rejoinGroups() error {
+	gc, ok := n.crypto.(GroupCrypto)
+	if !ok {
+		return nil
+	}
+	for _, group := range n.Groups() {
+		err := gc.JoinGroup(n.ctx, group, n.Name)
+		if err != nil {
+			return fmt.Errorf("rejoin %s: %w", group, err)
+		}
+	}
+	return nil
+}
+
+// IsGroup reports whether name is a group channel such as '@ops'.
+func IsGroup(name string) bool {
+	return msgspec.IsGroup(name)
+}
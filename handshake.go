@@ -0,0 +1,87 @@
+package rpipe
+
+import (
+	"errors"
+	"github.com/sng2c/rpipe/msgspec"
+	"time"
+)
+
+var ErrConnectTimeout = errors.New("connect timeout")
+
+// DefaultConnectTimeout is a suggested -connect-timeout. The handshake is
+// off unless asked for, since older targets never answer a hello.
+const DefaultConnectTimeout = 30 * time.Second
+
+// helloInterval is how often a hello is repeated until it is answered.
+const helloInterval = 500 * time.Millisecond
+
+// answerHello confirms a hello once it has been decrypted, which also
+// negotiates the symkey back to its sender.
+func (n *Node) answerHello(msg *msgspec.RpipeMsg) {
+	err := n.Publish(&msgspec.RpipeMsg{From: msg.To, To: msg.From, Control: msgspec.ControlReady, Data: msg.Data})
+	if err != nil {
+		n.msgLog(msg, msgspec.DirectionIn).Debugf("Failed to answer hello from %s: %v", msg.From, err)
+	}
+}
+
+// handshake tracks a pipe mode session waiting for its target: hellos are
+// repeated until the matching ready arrives. The timeout only runs while
+// local data is held back, so a receiver that has nothing to send waits
+// for its sender indefinitely.
+type handshake struct {
+	nonce   string
+	ready   bool
+	timeout time.Duration
+	hello   *time.Ticker
+	timer   *time.Timer
+}
+
+func newHandshake(timeout time.Duration) *handshake {
+	return &handshake{nonce: NewCallID(), timeout: timeout, hello: time.NewTicker(helloInterval)}
+}
+
+// waiting reports whether local data must be held back.
+func (h *handshake) waiting() bool {
+	return h != nil && !h.ready
+}
+
+// arm starts the timeout, once there is something to send.
+func (h *handshake) arm() {
+	if h.timer == nil {
+		h.timer = time.NewTimer(h.timeout)
+	}
+}
+
+// answeredBy reports whether msg completes the handshake.
+func (h *handshake) answeredBy(msg *msgspec.RpipeMsg) bool {
+	if !h.waiting() || msg.Control != msgspec.ControlReady || string(msg.Data) != h.nonce {
+		return false
+	}
+	h.stop()
+	h.ready = true
+	return true
+}
+
+func (h *handshake) helloC() <-chan time.Time {
+	if !h.waiting() {
+		return nil
+	}
+	return h.hello.C
+}
+
+func (h *handshake) timeoutC() <-chan time.Time {
+	if !h.waiting() || h.timer == nil {
+		return nil
+	}
+	return h.timer.C
+}
+
+func (h *handshake) stop() {
+	if h == nil {
+		return
+	}
+	h.hello.Stop()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
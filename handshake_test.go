@@ -0,0 +1,42 @@
+package rpipe
+
+import (
+	"github.com/sng2c/rpipe/msgspec"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	var none *handshake
+	if none.waiting() || none.helloC() != nil || none.timeoutC() != nil {
+		t.Fatal("a nil handshake should never wait")
+	}
+
+	h := newHandshake(time.Minute)
+	defer h.stop()
+	if !h.waiting() || h.helloC() == nil {
+		t.Fatal("expected a new handshake to wait and repeat hellos")
+	}
+	if h.timeoutC() != nil {
+		t.Fatal("the timeout should not run before there is data to send")
+	}
+	h.arm()
+	if h.timeoutC() == nil {
+		t.Fatal("expected the timeout to run once armed")
+	}
+
+	for _, msg := range []*msgspec.RpipeMsg{
+		{Control: msgspec.ControlReady, Data: []byte("stale")},
+		{Control: msgspec.ControlData, Data: []byte(h.nonce)},
+	} {
+		if h.answeredBy(msg) {
+			t.Fatalf("%+v should not complete the handshake", msg)
+		}
+	}
+	if !h.answeredBy(&msgspec.RpipeMsg{Control: msgspec.ControlReady, Data: []byte(h.nonce)}) {
+		t.Fatal("the matching ready should complete the handshake")
+	}
+	if h.waiting() || h.helloC() != nil || h.timeoutC() != nil {
+		t.Fatal("a completed handshake should not wait")
+	}
+}
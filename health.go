@@ -0,0 +1,87 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sng2c/rpipe/msgspec"
+	"strconv"
+)
+
+// Health check names, in the order Health runs them.
+const (
+	HealthRedis        = "redis"
+	HealthPubkey       = "pubkey"
+	HealthSubscription = "subscription"
+)
+
+var ErrProbeLost = errors.New("probe not received: subscription is not delivering")
+
+// HealthCheck is the result of one check.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewHealthCheck returns the check name, failed if err is not nil.
+func NewHealthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Error: err.Error()}
+	}
+	return HealthCheck{Name: name, OK: true}
+}
+
+// Health checks that Redis answers, that the pubkey registered under the
+// node's name is its own, and that its subscription still delivers: a
+// probe published to the node must come back before ctx is done. A
+// subscription can die while the node keeps publishing.
+func (n *Node) Health(ctx context.Context) []HealthCheck {
+	checks := []HealthCheck{NewHealthCheck(HealthRedis, n.rdb.Ping(ctx).Err())}
+	if v, ok := n.crypto.(interface {
+		VerifyPubkey(ctx context.Context, chnName string) error
+	}); ok {
+		checks = append(checks, NewHealthCheck(HealthPubkey, v.VerifyPubkey(ctx, n.Name)))
+	}
+	return append(checks, NewHealthCheck(HealthSubscription, n.probe(ctx)))
+}
+
+// probe publishes a ControlProbe to this node and waits until the receive
+// loop sees it.
+func (n *Node) probe(ctx context.Context) error {
+	nonce := strconv.FormatUint(n.probeSeq.Add(1), 10)
+	received := make(chan struct{})
+	n.peersMu.Lock()
+	n.probes[nonce] = received
+	n.peersMu.Unlock()
+	defer func() {
+		n.peersMu.Lock()
+		delete(n.probes, nonce)
+		n.peersMu.Unlock()
+	}()
+
+	msg := &msgspec.RpipeMsg{From: n.Name, To: n.Name, Control: msgspec.ControlProbe, Data: []byte(nonce)}
+	receivers, err := n.rdb.Publish(ctx, n.Name, msg.Marshal()).Result()
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return fmt.Errorf("%w: no subscriber on '%s'", ErrProbeLost, n.Name)
+	}
+	select {
+	case <-received:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrProbeLost, ctx.Err())
+	}
+}
+
+// probeReceived wakes up the probe waiting for nonce, if any.
+func (n *Node) probeReceived(nonce string) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	if received, ok := n.probes[nonce]; ok {
+		close(received)
+		delete(n.probes, nonce)
+	}
+}
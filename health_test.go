@@ -0,0 +1,59 @@
+package rpipe
+
+import (
+	"context"
+	"github.com/sng2c/rpipe/msgspec"
+	"testing"
+	"time"
+)
+
+func TestHealth_Unreachable(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	checks := n.Health(ctx)
+	want := []string{HealthRedis, HealthSubscription}
+	if len(checks) != len(want) {
+		t.Fatalf("want checks %v, got %+v", want, checks)
+	}
+	for i, check := range checks {
+		if check.Name != want[i] || check.OK || check.Error == "" {
+			t.Fatalf("want %s failed, got %+v", want[i], check)
+		}
+	}
+}
+
+func TestHandle_Probe(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	received := make(chan struct{})
+	n.probes["7"] = received
+
+	tests := []struct {
+		from     string
+		nonce    string
+		received bool
+	}{
+		{"mallory", "7", false},
+		{n.Name, "8", false},
+		{n.Name, "7", true},
+	}
+	for _, tt := range tests {
+		payload := (&msgspec.RpipeMsg{From: tt.from, Control: msgspec.ControlProbe, Data: []byte(tt.nonce)}).Marshal()
+		if msg := n.handle(n.Name, string(payload)); msg != nil {
+			t.Fatalf("probe should not be delivered, got %v", msg)
+		}
+		select {
+		case <-received:
+			if !tt.received {
+				t.Fatalf("probe %s from %s woke up the wait", tt.nonce, tt.from)
+			}
+		default:
+			if tt.received {
+				t.Fatalf("probe %s from %s was not received", tt.nonce, tt.from)
+			}
+		}
+	}
+	if len(n.probes) != 0 {
+		t.Fatalf("want the probe removed, got %v", n.probes)
+	}
+}
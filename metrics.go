@@ -0,0 +1,65 @@
+package rpipe
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry. Peer labels
+// are channel names, so their number grows with the peers a node talks to.
+var (
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "messages_sent_total",
+		Help:      "Messages published, by target.",
+	}, []string{"peer"})
+	bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "bytes_sent_total",
+		Help:      "Payload bytes published before encryption, by target.",
+	}, []string{"peer"})
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "messages_received_total",
+		Help:      "Messages received and decrypted, by sender.",
+	}, []string{"peer"})
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "bytes_received_total",
+		Help:      "Payload bytes received after decryption, by sender.",
+	}, []string{"peer"})
+	publishErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "publish_errors_total",
+		Help:      "Publishes that failed after any retries, by target.",
+	}, []string{"peer"})
+	publishRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "publish_retries_total",
+		Help:      "Publishes retried while Redis was unreachable.",
+	})
+	publishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "rpipe",
+		Name:      "publish_duration_seconds",
+		Help:      "Time to seal and publish one message, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	droppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "dropped_messages_total",
+		Help:      "Received messages dropped, by reason: parse, decrypt, group, not_from_target.",
+	}, []string{"reason"})
+	queueLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "rpipe",
+		Name:      "queue_latency_seconds",
+		Help:      "Time messages waited in a queue stream before an instance took them.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	// ChildRestarts counts restarts of supervised commands.
+	ChildRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "child_restarts_total",
+		Help:      "Restarts of supervised commands.",
+	})
+)
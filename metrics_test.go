@@ -0,0 +1,31 @@
+package rpipe
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sng2c/rpipe/msgspec"
+	"testing"
+)
+
+func TestHandle_Metrics(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	n.Name = "metrics-alice"
+
+	parseDrops := testutil.ToFloat64(droppedMessages.WithLabelValues("parse"))
+	if msg := n.handle(n.Name, "not json"); msg != nil {
+		t.Fatalf("want a dropped message, got %v", msg)
+	}
+	if got := testutil.ToFloat64(droppedMessages.WithLabelValues("parse")); got != parseDrops+1 {
+		t.Fatalf("parse drops: want %v, got %v", parseDrops+1, got)
+	}
+
+	payload := (&msgspec.RpipeMsg{From: "metrics-bob", Data: []byte("hello")}).Marshal()
+	if msg := n.handle(n.Name, string(payload)); msg == nil {
+		t.Fatal("want the message delivered")
+	}
+	if got := testutil.ToFloat64(messagesReceived.WithLabelValues("metrics-bob")); got != 1 {
+		t.Fatalf("messages received: want 1, got %v", got)
+	}
+	if got := testutil.ToFloat64(bytesReceived.WithLabelValues("metrics-bob")); got != 5 {
+		t.Fatalf("bytes received: want 5, got %v", got)
+	}
+}
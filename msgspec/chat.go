@@ -0,0 +1,83 @@
+package msgspec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// ChatMsg types. A ChatMsg without one is a ChatMessage.
+const (
+	ChatMessage = "message"
+	// ChatCall is a received RPC call, answered by a ChatReply with the
+	// same Cid.
+	ChatCall  = "call"
+	ChatReply = "reply"
+	// ChatBroadcast sends Data to every other online node.
+	ChatBroadcast = "broadcast"
+	// ChatClose tells that the sender has finished sending on Stream.
+	ChatClose = "close"
+)
+
+// ChatMsg is a chat mode message in the JSON chat format, one object per
+// line. Data is text, or base64 if Base64 is set, for payloads that are
+// not valid UTF-8.
+type ChatMsg struct {
+	Type   string `json:"type,omitempty"` // see Chat* constants
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Stream uint32 `json:"stream,omitempty"`
+	Cid    string `json:"cid,omitempty"` // correlation id of a call
+	Data   string `json:"data"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+// NewChatMsg returns the ChatMsg carrying data, base64 encoded unless it
+// is valid UTF-8.
+func NewChatMsg(from, to string, data []byte) *ChatMsg {
+	m := &ChatMsg{From: from, To: to}
+	if utf8.Valid(data) {
+		m.Data = string(data)
+	} else {
+		m.Data = base64.StdEncoding.EncodeToString(data)
+		m.Base64 = true
+	}
+	return m
+}
+
+// ParseChatMsg parses a line of the JSON chat format.
+func ParseChatMsg(line []byte) (*ChatMsg, error) {
+	m := &ChatMsg{}
+	err := json.Unmarshal(line, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Payload returns Data, decoded if it is base64.
+func (m *ChatMsg) Payload() ([]byte, error) {
+	if !m.Base64 {
+		return []byte(m.Data), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return nil, errors.New("invalid base64 data: " + err.Error())
+	}
+	return data, nil
+}
+
+// Encode returns m as a JSON line, without the newline. '<', '>' and '&'
+// are not escaped.
+func (m *ChatMsg) Encode() []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(m)
+	if err != nil {
+		return nil
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+}
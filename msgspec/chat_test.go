@@ -0,0 +1,41 @@
+package msgspec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChatMsg(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"text", []byte("hi\nthere <b>"), `{"from":"bob","data":"hi\nthere <b>"}`},
+		{"binary", []byte{0xff, 0x00, '\n'}, `{"from":"bob","data":"/wAK","base64":true}`},
+		{"empty", nil, `{"from":"bob","data":""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := NewChatMsg("bob", "", tt.data).Encode()
+			if string(line) != tt.want {
+				t.Fatalf("Encode() = %s, want %s", line, tt.want)
+			}
+			m, err := ParseChatMsg(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := m.Payload()
+			if err != nil || !bytes.Equal(data, tt.data) {
+				t.Fatalf("Payload() = %q, %v, want %q", data, err, tt.data)
+			}
+		})
+	}
+
+	if _, err := ParseChatMsg([]byte("bob<hi")); err == nil {
+		t.Error("ParseChatMsg() accepted the text format")
+	}
+	if _, err := (&ChatMsg{Data: "!", Base64: true}).Payload(); err == nil {
+		t.Error("Payload() accepted invalid base64")
+	}
+}
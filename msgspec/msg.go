@@ -7,13 +7,116 @@ import (
 	"fmt"
 )
 
+// Control values carried in RpipeMsg.Control.
+const (
+	ControlData        = 0
+	ControlResetSymkey = 1
+	ControlEOF         = 2
+	ControlAck         = 3
+	// ControlStreamOpen opens Stream; Data is its label, e.g. a destination.
+	ControlStreamOpen = 4
+	// ControlStreamClose ends the sender's side of Stream, like a TCP FIN.
+	ControlStreamClose = 5
+	// ControlForwardListen asks the peer to listen for a remote forward;
+	// Data is a JSON encoded forward spec and Cid identifies the request.
+	ControlForwardListen = 6
+	// ControlStreamReset aborts Stream in both directions; Data is the reason.
+	ControlStreamReset = 7
+	// ControlStreamAccept confirms that the receiver of ControlStreamOpen
+	// has set up its end of Stream, e.g. connected to the destination.
+	ControlStreamAccept = 8
+	// ControlCall is a request; Data is the payload and Cid identifies it.
+	ControlCall = 9
+	// ControlReply answers the ControlCall with the same Cid.
+	ControlReply = 10
+	// ControlHello asks the receiver to answer with ControlReady; Data is
+	// a nonce, sealed so that the symkey is negotiated on the way.
+	ControlHello = 11
+	// ControlReady answers ControlHello with the same Data.
+	ControlReady = 12
+	// ControlProbe is published by a node to itself to check that its
+	// subscription still delivers; Data is a nonce.
+	ControlProbe = 13
+	// ControlForwardResult answers the ControlForwardListen with the same
+	// Cid; Data is empty if the peer listens, or why it does not.
+	ControlForwardResult = 14
+)
+
 type RpipeMsg struct {
 	From    string `json:"from,omitempty"`
 	To      string `json:"to,omitempty"`
 	Data    []byte `json:"data,omitempty"`
 	Secured bool   `json:"sec,omitempty"`
-	Control int    `json:"ctl,omitempty"` // 0: msg, 1: reset Symkey, 2: EOF
+	Control int    `json:"ctl,omitempty"` // see Control* constants
 	Pipe    bool   `json:"pipe,omitempty"`
+	Ack     int64  `json:"ack,omitempty"`   // bytes consumed, with Control=3
+	Stream  uint32 `json:"sid,omitempty"`   // 0: the default stream
+	Epoch   int64  `json:"epoch,omitempty"` // group key epoch, with a group To
+	Cid     string `json:"cid,omitempty"`   // correlation id, with Control=6/9/10/14
+	More    bool   `json:"more,omitempty"`  // the next message continues Data
+}
+
+var controlNames = map[int]string{
+	ControlData:          "data",
+	ControlResetSymkey:   "reset_symkey",
+	ControlEOF:           "eof",
+	ControlAck:           "ack",
+	ControlStreamOpen:    "stream_open",
+	ControlStreamClose:   "stream_close",
+	ControlForwardListen: "forward_listen",
+	ControlStreamReset:   "stream_reset",
+	ControlStreamAccept:  "stream_accept",
+	ControlCall:          "call",
+	ControlReply:         "reply",
+	ControlHello:         "hello",
+	ControlReady:         "ready",
+	ControlProbe:         "probe",
+	ControlForwardResult: "forward_result",
+}
+
+// ControlName returns the name of a Control value for logs, such as "eof".
+func ControlName(control int) string {
+	if name, ok := controlNames[control]; ok {
+		return name
+	}
+	return fmt.Sprintf("control_%d", control)
+}
+
+// Directions of a message in LogFields.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// LogFields describes m for structured logs. The node is the local end and
+// the peer the remote one, so they depend on the direction.
+func (m *RpipeMsg) LogFields(direction string) map[string]interface{} {
+	node, peer := m.From, m.To
+	if direction == DirectionIn {
+		node, peer = m.To, m.From
+	}
+	fields := map[string]interface{}{
+		"node":      node,
+		"peer":      peer,
+		"direction": direction,
+		"control":   ControlName(m.Control),
+		"size":      len(m.Data),
+	}
+	if m.Epoch != 0 {
+		fields["epoch"] = m.Epoch
+	}
+	if m.Stream != 0 {
+		fields["stream"] = m.Stream
+	}
+	if m.Cid != "" {
+		fields["cid"] = m.Cid
+	}
+	return fields
+}
+
+// IsGroup reports whether name is a group channel such as '@ops'.
+func IsGroup(name string) bool {
+	return len(name) > 1 && name[0] == '@'
 }
 
 func (m *RpipeMsg) SymkeyName() string {
@@ -56,6 +159,15 @@ func NewApplicationMsg(s []byte) (*ApplicationMsg, error) {
 	}
 	return &msg, nil
 }
+
+// DecodeApplicationMsg parses a line written by Encode, 'NAME>data'.
+func DecodeApplicationMsg(s []byte) (*ApplicationMsg, error) {
+	name, data, ok := bytes.Cut(s, []byte{'>'})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid ApplicationMsg format: %s", s))
+	}
+	return &ApplicationMsg{Name: string(name), Data: data}, nil
+}
 func (m *ApplicationMsg) Encode() []byte {
 	return bytes.Join([][]byte{[]byte(m.Name), m.Data}, []byte{'>'})
 }
@@ -0,0 +1,63 @@
+package msgspec
+
+import (
+	"testing"
+)
+
+func TestLogFields(t *testing.T) {
+	msg := &RpipeMsg{From: "alice", To: "bob", Data: []byte("hi"), Control: ControlEOF, Epoch: 3}
+	tests := []struct {
+		direction string
+		node      string
+		peer      string
+	}{
+		{DirectionOut, "alice", "bob"},
+		{DirectionIn, "bob", "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.direction, func(t *testing.T) {
+			f := msg.LogFields(tt.direction)
+			if f["node"] != tt.node || f["peer"] != tt.peer || f["direction"] != tt.direction {
+				t.Errorf("LogFields() = %v", f)
+			}
+			if f["control"] != "eof" || f["size"] != 2 || f["epoch"] != int64(3) {
+				t.Errorf("LogFields() = %v", f)
+			}
+			if _, ok := f["stream"]; ok {
+				t.Errorf("LogFields() has stream for the default stream: %v", f)
+			}
+		})
+	}
+	if got := ControlName(99); got != "control_99" {
+		t.Errorf("ControlName(99) = %s", got)
+	}
+}
+
+func TestDecodeApplicationMsg(t *testing.T) {
+	tests := []struct {
+		line    string
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"bob>hi", "bob", "hi", false},
+		{"@ops/carol>a>b", "@ops/carol", "a>b", false},
+		{">hi", "", "hi", false},
+		{"bob<hi", "", "", true},
+	}
+	for _, tt := range tests {
+		m, err := DecodeApplicationMsg([]byte(tt.line))
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("DecodeApplicationMsg(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if m.Name != tt.name || string(m.Data) != tt.data {
+			t.Errorf("DecodeApplicationMsg(%q) = %q, %q", tt.line, m.Name, m.Data)
+		}
+		if string(m.Encode()) != tt.line {
+			t.Errorf("Encode() = %q, want %q", m.Encode(), tt.line)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package msgspec
+
+// MatchPattern reports whether channel matches a Redis PSUBSCRIBE glob:
+// '*' and '?' match any run and any single byte, '[...]' a class with
+// optional '^' negation and 'a-z' ranges, and '\' escapes the next byte.
+func MatchPattern(pattern, channel string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(channel); i++ {
+				if MatchPattern(pattern[1:], channel[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(channel) == 0 {
+				return false
+			}
+		case '[':
+			if len(channel) == 0 {
+				return false
+			}
+			var ok bool
+			ok, pattern = matchClass(pattern[1:], channel[0])
+			if !ok {
+				return false
+			}
+			channel = channel[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(channel) == 0 || pattern[0] != channel[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		channel = channel[1:]
+	}
+	return len(channel) == 0
+}
+
+// matchClass matches c against the class body after '[' and returns the
+// pattern following the closing ']'.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			match = match || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			match = match || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return match != negate, pattern
+}
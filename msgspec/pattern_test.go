@@ -0,0 +1,34 @@
+package msgspec
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		channel string
+		want    bool
+	}{
+		{"logs.*", "logs.web1", true},
+		{"logs.*", "logs.", true},
+		{"logs.*", "logs", false},
+		{"logs.*", "metrics.web1", false},
+		{"*", "anything", true},
+		{"logs.*.err", "logs.web1.err", true},
+		{"logs.*.err", "logs.web1.out", false},
+		{"logs.web?", "logs.web1", true},
+		{"logs.web?", "logs.web12", false},
+		{"logs.web[12]", "logs.web2", true},
+		{"logs.web[12]", "logs.web3", false},
+		{"logs.web[^12]", "logs.web3", true},
+		{"logs.web[0-9]", "logs.web7", true},
+		{"logs.web[0-9]", "logs.webx", false},
+		{`logs.\*`, "logs.*", true},
+		{`logs.\*`, "logs.web1", false},
+		{"a**b", "axxb", true},
+	}
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.channel); got != tt.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tt.pattern, tt.channel, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"io"
+	"sync"
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+var ErrMuxClosed = errors.New("mux closed")
+
+// StreamResetError is returned by Stream reads and writes after either
+// side reset the stream.
+type StreamResetError struct {
+	Reason string
+}
+
+func (e *StreamResetError) Error() string {
+	return "stream reset: " + e.Reason
+}
+
+type MuxOptions struct {
+	// Target is the peer the streams are exchanged with. Messages from
+	// other senders are ignored.
+	Target string
+	// Window is the per-stream flow control window in bytes. Zero uses
+	// DefaultWindow.
+	Window int
+	// OnStream is called in its own goroutine for every stream the peer
+	// opens. Without it, incoming streams are reset.
+	OnStream func(st *Stream)
+	// OnMessage is called for messages that do not belong to a stream.
+	OnMessage func(msg *msgspec.RpipeMsg)
+}
+
+// Mux carries many independent streams between a Node and one peer.
+//
+// A stream is opened with ControlStreamOpen, whose payload is a label such
+// as a destination address. Data messages carry the stream id and are
+// flow controlled per stream with ControlAck. ControlStreamClose is a half
+// close: each direction ends independently, and the stream is finished
+// once both have. ControlStreamReset aborts both directions. The receiver
+// may confirm a stream with ControlStreamAccept, for openers that need to
+// know it was set up before using it.
+type Mux struct {
+	node *Node
+	opts MuxOptions
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	closed  bool
+}
+
+func NewMux(node *Node, opts MuxOptions) *Mux {
+	if opts.Window <= 0 {
+		opts.Window = DefaultWindow
+	}
+	m := &Mux{
+		node:    node,
+		opts:    opts,
+		streams: make(map[uint32]*Stream),
+	}
+	// Both sides open streams, so they allocate from disjoint id spaces.
+	m.nextID = 2
+	if node.Name < opts.Target {
+		m.nextID = 1
+	}
+	return m
+}
+
+// Open starts a new stream with the given label.
+func (m *Mux) Open(label string) (*Stream, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrMuxClosed
+	}
+	st := m.newStream(m.nextID, label)
+	m.nextID += 2
+	m.mu.Unlock()
+
+	err := m.node.Publish(&msgspec.RpipeMsg{To: m.opts.Target, Control: msgspec.ControlStreamOpen, Stream: st.ID, Data: []byte(label)})
+	if err != nil {
+		m.remove(st.ID)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Run dispatches messages from the peer until ctx is cancelled or the node
+// is closed. All remaining streams are reset when it returns.
+func (m *Mux) Run(ctx context.Context) error {
+	defer m.shutdown()
+	remoteCh := m.node.Receive()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-remoteCh:
+			if !ok {
+				return nil
+			}
+			if msg.From != m.opts.Target {
+				m.node.msgLog(msg, msgspec.DirectionIn).Warningf("Ignoring message from %s: not from target", msg.From)
+				droppedMessages.WithLabelValues("not_from_target").Inc()
+				continue
+			}
+			m.dispatch(msg)
+		}
+	}
+}
+
+func (m *Mux) shutdown() {
+	m.mu.Lock()
+	m.closed = true
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, st := range m.streams {
+		streams = append(streams, st)
+	}
+	m.mu.Unlock()
+	for _, st := range streams {
+		_ = st.Reset("shutting down")
+	}
+}
+
+func (m *Mux) dispatch(msg *msgspec.RpipeMsg) {
+	if msg.Stream == 0 {
+		if m.opts.OnMessage != nil {
+			m.opts.OnMessage(msg)
+		}
+		return
+	}
+	if msg.Control == msgspec.ControlStreamOpen {
+		m.accept(msg.Stream, string(msg.Data))
+		return
+	}
+	st := m.stream(msg.Stream)
+	if st == nil {
+		m.node.msgLog(msg, msgspec.DirectionIn).Debugf("Message for unknown stream %d", msg.Stream)
+		return
+	}
+	switch msg.Control {
+	case msgspec.ControlData:
+		st.queue.push(msg.Data)
+	case msgspec.ControlAck:
+		st.onAck(msg.Ack)
+	case msgspec.ControlStreamClose:
+		st.queue.close()
+	case msgspec.ControlStreamAccept:
+		st.acceptOnce.Do(func() { close(st.accepted) })
+	case msgspec.ControlStreamReset:
+		st.onReset(string(msg.Data), false)
+	}
+}
+
+func (m *Mux) accept(id uint32, label string) {
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok || m.closed || m.opts.OnStream == nil {
+		m.mu.Unlock()
+		log.Debugf("Refusing stream %d '%s'", id, label)
+		_ = m.node.Publish(&msgspec.RpipeMsg{To: m.opts.Target, Control: msgspec.ControlStreamReset, Stream: id, Data: []byte("refused")})
+		return
+	}
+	st := m.newStream(id, label)
+	m.mu.Unlock()
+	go m.opts.OnStream(st)
+}
+
+// newStream registers a stream. m.mu must be held.
+func (m *Mux) newStream(id uint32, label string) *Stream {
+	st := &Stream{
+		ID:       id,
+		Label:    label,
+		mux:      m,
+		queue:    newByteQueue(),
+		window:   newSendWindow(m.opts.Window),
+		accepted: make(chan struct{}),
+		reset:    make(chan struct{}),
+	}
+	st.cond = sync.NewCond(&st.mu)
+	m.streams[id] = st
+	return st
+}
+
+func (m *Mux) stream(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *Mux) publish(st *Stream, control int, data []byte, ack int64) error {
+	return m.node.Publish(&msgspec.RpipeMsg{To: m.opts.Target, Control: control, Stream: st.ID, Data: data, Ack: ack})
+}
+
+// Stream is one bidirectional byte stream of a Mux. Reads and writes may
+// run concurrently with each other.
+type Stream struct {
+	ID    uint32
+	Label string
+
+	mux   *Mux
+	queue *byteQueue
+	recv  recvWindow
+	rest  []byte
+
+	writeMu sync.Mutex
+
+	acceptOnce sync.Once
+	accepted   chan struct{}
+	reset      chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	window   *sendWindow
+	sentEOF  bool
+	recvEOF  bool
+	resetErr error
+}
+
+// Read returns data from the peer, io.EOF once the peer has closed its
+// side, or a *StreamResetError.
+func (st *Stream) Read(p []byte) (int, error) {
+	if len(st.rest) == 0 {
+		data, ok := st.queue.pop()
+		if !ok {
+			st.mu.Lock()
+			err := st.resetErr
+			st.mu.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			st.onRecvEOF()
+			return 0, io.EOF
+		}
+		st.rest = data
+	}
+	n := copy(p, st.rest)
+	st.rest = st.rest[n:]
+	if ack, due := st.recv.onConsumed(n); due {
+		err := st.mux.publish(st, msgspec.ControlAck, nil, ack)
+		if err != nil {
+			log.Debugf("Stream %d: failed to send ack: %v", st.ID, err)
+		}
+	}
+	return n, nil
+}
+
+// Write sends p to the peer, blocking while the flow control window is
+// exhausted.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.window.exhausted() && st.resetErr == nil {
+			st.cond.Wait()
+		}
+		err := st.resetErr
+		if err == nil && st.sentEOF {
+			err = ErrStreamClosed
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+		chunk := min(len(p), st.mux.node.opts.BlockSize)
+		st.window.onSent(chunk)
+		st.mu.Unlock()
+
+		err = st.mux.publish(st, msgspec.ControlData, p[:chunk], 0)
+		if err != nil {
+			return written, err
+		}
+		written += chunk
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Accept tells the peer that this side of a stream it opened is ready.
+func (st *Stream) Accept() error {
+	return st.mux.publish(st, msgspec.ControlStreamAccept, nil, 0)
+}
+
+// WaitAccepted blocks until the peer accepts the stream. It returns the
+// *StreamResetError if the peer refuses it instead.
+func (st *Stream) WaitAccepted(ctx context.Context) error {
+	select {
+	case <-st.accepted:
+		return nil
+	case <-st.reset:
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.resetErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseWrite ends this side of the stream. The peer reads io.EOF, and can
+// keep writing until it closes its own side.
+func (st *Stream) CloseWrite() error {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	st.mu.Lock()
+	if st.sentEOF || st.resetErr != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sentEOF = true
+	done := st.recvEOF
+	st.mu.Unlock()
+	err := st.mux.publish(st, msgspec.ControlStreamClose, nil, 0)
+	if done {
+		st.mux.remove(st.ID)
+	}
+	return err
+}
+
+// Close ends the stream. If the peer has not finished sending, the stream
+// is reset, since its remaining data would be lost.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	recvEOF := st.recvEOF
+	st.mu.Unlock()
+	if !recvEOF {
+		return st.Reset("closed")
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts both directions and tells the peer why.
+func (st *Stream) Reset(reason string) error {
+	if !st.onReset(reason, true) {
+		return nil
+	}
+	return st.mux.publish(st, msgspec.ControlStreamReset, []byte(reason), 0)
+}
+
+// onReset marks the stream reset. It reports false if it already was.
+func (st *Stream) onReset(reason string, local bool) bool {
+	st.mu.Lock()
+	if st.resetErr != nil || (st.sentEOF && st.recvEOF) {
+		st.mu.Unlock()
+		return false
+	}
+	st.resetErr = &StreamResetError{Reason: reason}
+	st.mu.Unlock()
+	close(st.reset)
+	st.cond.Broadcast()
+	st.queue.close()
+	st.queue.drop()
+	st.mux.remove(st.ID)
+	if !local {
+		log.Debugf("Stream %d reset by peer: %s", st.ID, reason)
+	}
+	return true
+}
+
+func (st *Stream) onRecvEOF() {
+	st.mu.Lock()
+	st.recvEOF = true
+	done := st.sentEOF
+	st.mu.Unlock()
+	if done {
+		st.mux.remove(st.ID)
+	}
+}
+
+func (st *Stream) onAck(consumed int64) {
+	st.mu.Lock()
+	st.window.onAck(consumed)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *Stream) String() string {
+	return fmt.Sprintf("stream %d '%s'", st.ID, st.Label)
+}
+
+// byteQueue is an unbounded FIFO of payloads. The sender's flow control
+// window bounds how much it holds.
+type byteQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  [][]byte
+	closed bool
+}
+
+func newByteQueue() *byteQueue {
+	q := &byteQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *byteQueue) push(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, data)
+	q.cond.Signal()
+}
+
+// pop blocks for the next payload. It returns false once the queue is
+// closed and drained.
+func (q *byteQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	data := q.items[0]
+	q.items = q.items[1:]
+	return data, true
+}
+
+func (q *byteQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *byteQueue) drop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = nil
+}
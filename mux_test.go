@@ -0,0 +1,65 @@
+package rpipe
+
+import (
+	"errors"
+	"github.com/sng2c/rpipe/msgspec"
+	"io"
+	"testing"
+)
+
+func TestMux_IncomingStream(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1})
+	accepted := make(chan *Stream, 2)
+	m := NewMux(n, MuxOptions{Target: "bob", OnStream: func(st *Stream) { accepted <- st }})
+	if m.nextID != 1 {
+		t.Fatalf("alice < bob should open odd ids, got %d", m.nextID)
+	}
+
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Control: msgspec.ControlStreamOpen, Stream: 2, Data: []byte("db:5432")})
+	st := <-accepted
+	if st.ID != 2 || st.Label != "db:5432" {
+		t.Fatalf("unexpected stream %s", st)
+	}
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Stream: 2, Data: []byte("hello ")})
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Stream: 2, Data: []byte("world")})
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Control: msgspec.ControlStreamClose, Stream: 2})
+	got, err := io.ReadAll(st)
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Control: msgspec.ControlStreamOpen, Stream: 4, Data: []byte("db:5432")})
+	st = <-accepted
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Stream: 4, Data: []byte("lost")})
+	m.dispatch(&msgspec.RpipeMsg{From: "bob", Control: msgspec.ControlStreamReset, Stream: 4, Data: []byte("connection refused")})
+	var resetErr *StreamResetError
+	if _, err := st.Read(make([]byte, 8)); !errors.As(err, &resetErr) || resetErr.Reason != "connection refused" {
+		t.Fatalf("want reset error, got %v", err)
+	}
+	if _, err := st.Write([]byte("x")); !errors.As(err, &resetErr) {
+		t.Fatalf("want reset error on write, got %v", err)
+	}
+	if m.stream(4) != nil {
+		t.Fatal("reset stream should be removed")
+	}
+}
+
+func TestByteQueue(t *testing.T) {
+	q := newByteQueue()
+	q.push([]byte("a"))
+	q.push([]byte("b"))
+	q.close()
+	q.push([]byte("c"))
+
+	var got string
+	for {
+		data, ok := q.pop()
+		if !ok {
+			break
+		}
+		got += string(data)
+	}
+	if got != "ab" {
+		t.Fatalf("want queued data drained before close, got %q", got)
+	}
+}
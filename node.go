@@ -0,0 +1,493 @@
+// Package rpipe bridges processes over Redis pub/sub channels with
+// end-to-end encryption. A Node owns one channel name and exchanges
+// messages with other nodes; a Session connects a Node to local
+// stdin/stdout-style byte channels the way the rpipe command does.
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"github.com/sng2c/rpipe/secure"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const Version = "1.1.0"
+
+const DefaultBlockSize = 512 * 1024
+
+var ErrNoTarget = errors.New("no target in message")
+var ErrNoReceivers = errors.New("no receivers")
+
+// closeTimeout bounds the Redis cleanup done by Close.
+const closeTimeout = 5 * time.Second
+
+// waitReceiverPoll is how often WaitForReceiver checks for a subscriber.
+const waitReceiverPoll = 200 * time.Millisecond
+
+// Crypto seals outbound and opens inbound message payloads.
+// *secure.Cryptor is the default implementation.
+type Crypto interface {
+	RegisterPubkey(ctx context.Context, chnName string) error
+	PubkeyRegistered(ctx context.Context, chnName string) (bool, error)
+	ClearSymkeys()
+	ResetInboundSymkey(ctx context.Context, msg *msgspec.RpipeMsg) error
+	Seal(ctx context.Context, msg *msgspec.RpipeMsg) error
+	Open(ctx context.Context, msg *msgspec.RpipeMsg) error
+}
+
+type Options struct {
+	// RedisURL is used to create a client when Redis is nil.
+	RedisURL string
+	// TLS configures rediss:// connections made from RedisURL.
+	TLS *TLSOptions
+	// Redis is an existing client. It is not closed by Node.Close.
+	Redis redis.UniversalClient
+
+	// Nonsecure disables encryption of outgoing payloads. Secured
+	// incoming payloads are still decrypted.
+	Nonsecure bool
+	// Crypto overrides the default secure.Cryptor.
+	Crypto Crypto
+
+	// Pipe marks outgoing messages as pipe mode data.
+	Pipe bool
+	// BlockSize is the largest payload sent in a single message.
+	BlockSize int
+
+	// RetryWindow is how long a failed publish is retried. Zero uses
+	// DefaultRetryWindow, a negative value disables retries.
+	RetryWindow time.Duration
+	// PingInterval is how often the connection and pubkey registration
+	// are checked. Zero uses DefaultPingInterval.
+	PingInterval time.Duration
+
+	// OnControl is called for every control message received, after the
+	// node has handled symkey resets itself.
+	OnControl func(msg *msgspec.RpipeMsg)
+
+	// Ephemeral removes the node's pubkey from Redis on Close, for short
+	// lived nodes with generated names.
+	Ephemeral bool
+	// Mode describes the node in its presence record, e.g. 'chat'.
+	Mode string
+	// RequireReceiver fails a publish that no subscriber received with
+	// ErrNoReceivers. Otherwise a warning is logged.
+	RequireReceiver bool
+}
+
+// Node is a named endpoint on Redis pub/sub.
+type Node struct {
+	Name string
+
+	opts      Options
+	rdb       redis.UniversalClient
+	ownsRedis bool
+	pubsub    *redis.PubSub
+	crypto    Crypto
+	recvCh    chan *msgspec.RpipeMsg
+
+	connected    atomic.Bool
+	peersMu      sync.Mutex // guards peers, groups, patterns, queues, the checks and probes
+	peers        map[string]bool
+	groups       map[string]bool
+	patterns     map[string]bool
+	queues       map[string]bool
+	queueChecks  map[string]queueCheck
+	onlineChecks map[string]time.Time
+	undelivered  map[string]bool
+	probes       map[string]chan struct{}
+	probeSeq     atomic.Uint64
+	started      time.Time
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Open connects to Redis, subscribes to the channel name and registers
+// this node's public key.
+func Open(name string, opts *Options) (*Node, error) {
+	if name == "" {
+		return nil, errors.New("node name is required")
+	}
+	n := &Node{
+		Name:         name,
+		peers:        make(map[string]bool),
+		groups:       make(map[string]bool),
+		patterns:     make(map[string]bool),
+		queues:       make(map[string]bool),
+		queueChecks:  make(map[string]queueCheck),
+		onlineChecks: make(map[string]time.Time),
+		undelivered:  make(map[string]bool),
+		probes:       make(map[string]chan struct{}),
+		started:      time.Now(),
+	}
+	if opts != nil {
+		n.opts = *opts
+	}
+	if n.opts.BlockSize <= 0 {
+		n.opts.BlockSize = DefaultBlockSize
+	}
+	if n.opts.RetryWindow == 0 {
+		n.opts.RetryWindow = DefaultRetryWindow
+	}
+	if n.opts.PingInterval <= 0 {
+		n.opts.PingInterval = DefaultPingInterval
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	n.rdb = n.opts.Redis
+	if n.rdb == nil {
+		redisURL := n.opts.RedisURL
+		if redisURL == "" {
+			redisURL = DefaultRedisURL
+		}
+		rdb, err := NewRedisClient(redisURL, n.opts.TLS)
+		if err != nil {
+			n.cancel()
+			return nil, err
+		}
+		n.rdb = rdb
+		n.ownsRedis = true
+	}
+
+	_, err := n.rdb.Ping(n.ctx).Result()
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("redis ping failed: %w", err)
+	}
+	n.pubsub = n.rdb.Subscribe(n.ctx, name)
+
+	n.crypto = n.opts.Crypto
+	if n.crypto == nil {
+		n.crypto = secure.NewCryptor(n.rdb)
+	}
+	err = n.crypto.RegisterPubkey(n.ctx, name)
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("register pubkey: %w", err)
+	}
+	err = n.refreshPresence(true)
+	if err != nil {
+		log.Warningln("Failed to announce presence", err)
+	}
+
+	n.connected.Store(true)
+
+	n.recvCh = make(chan *msgspec.RpipeMsg)
+	n.wg.Add(2)
+	go n.receiveLoop()
+	go n.watchConnection()
+	return n, nil
+}
+
+// Redis returns the client the node publishes with.
+func (n *Node) Redis() redis.UniversalClient {
+	return n.rdb
+}
+
+// Receive returns the channel of incoming messages. Payloads are already
+// decrypted. Control messages other than symkey resets are delivered too,
+// so callers can observe EOF. The channel is closed by Close.
+func (n *Node) Receive() <-chan *msgspec.RpipeMsg {
+	return n.recvCh
+}
+
+// Send delivers data to the channel to, split into BlockSize messages
+// marked with More but the last. A group such as '@ops' that this node has
+// joined reaches every member.
+func (n *Node) Send(to string, data []byte) error {
+	return n.SendStream(to, 0, data)
+}
+
+// SendStream is Send, with the messages tagged with stream.
+func (n *Node) SendStream(to string, stream uint32, data []byte) error {
+	for len(data) > n.opts.BlockSize {
+		err := n.Publish(&msgspec.RpipeMsg{To: to, Stream: stream, Data: data[:n.opts.BlockSize], More: true})
+		if err != nil {
+			return err
+		}
+		data = data[n.opts.BlockSize:]
+	}
+	return n.Publish(&msgspec.RpipeMsg{To: to, Stream: stream, Data: data})
+}
+
+// SendEOF tells the channel to that this node has finished sending.
+func (n *Node) SendEOF(to string) error {
+	return n.Publish(&msgspec.RpipeMsg{To: to, Control: msgspec.ControlEOF})
+}
+
+// Publish fills in the sender, encrypts any payload and publishes msg
+// to msg.To. Failures are retried for RetryWindow, so a short Redis outage
+// blocks the caller instead of losing the message. A message to a node
+// that is not running fails at once with ErrTargetOffline, see
+// checkOnline, and one that no subscriber received is reported, see
+// Options.RequireReceiver. msg.From is kept if it is a channel matching
+// one of the node's patterns.
+func (n *Node) Publish(msg *msgspec.RpipeMsg) error {
+	if msg.To == "" {
+		return ErrNoTarget
+	}
+	if !n.receivesOn(msg.From) {
+		msg.From = n.Name
+	}
+	msg.Pipe = n.opts.Pipe
+
+	start := time.Now()
+	deadline := start.Add(n.opts.RetryWindow)
+	backoff := minRetryBackoff
+	for {
+		err := n.publishOnce(msg)
+		if err == nil {
+			n.addPeer(msg.To)
+			publishDuration.Observe(time.Since(start).Seconds())
+			messagesSent.WithLabelValues(msg.To).Inc()
+			bytesSent.WithLabelValues(msg.To).Add(float64(len(msg.Data)))
+			return nil
+		}
+		if errors.Is(err, redis.Nil) || errors.Is(err, secure.NoPubkeyError) || errors.Is(err, secure.NotMemberError) || errors.Is(err, ErrTargetOffline) || errors.Is(err, ErrNoReceivers) || n.ctx.Err() != nil || time.Now().Add(backoff).After(deadline) {
+			publishErrors.WithLabelValues(msg.To).Inc()
+			return err
+		}
+		publishRetries.Inc()
+		n.msgLog(msg, msgspec.DirectionOut).Warningf("Publish to %s failed, retrying in %s: %v", msg.To, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// publishOnce seals a copy of msg, so a retry starts from the plaintext.
+func (n *Node) publishOnce(msg *msgspec.RpipeMsg) error {
+	err := n.checkOnline(msg.To)
+	if err != nil {
+		return err
+	}
+	out := *msg
+	if !n.opts.Nonsecure && len(out.Data) > 0 {
+		err := n.crypto.Seal(n.ctx, &out)
+		if err != nil {
+			return err
+		}
+	}
+	msgJson := out.Marshal()
+	if !msgspec.IsGroup(out.To) {
+		queued, err := n.IsQueue(out.To)
+		if err != nil {
+			return err
+		}
+		if queued {
+			n.msgLog(&out, msgspec.DirectionOut).Debugf("[XADD-%s] %s", out.To, msgJson)
+			return n.publishQueued(out.To, msgJson)
+		}
+	}
+	n.msgLog(&out, msgspec.DirectionOut).Debugf("[PUB-%s] %s", out.To, msgJson)
+	receivers, err := n.rdb.Publish(n.ctx, out.To, msgJson).Result()
+	if err != nil {
+		return err
+	}
+	if msgspec.IsGroup(out.To) && n.inGroup(out.To) {
+		// our own subscription
+		receivers--
+	}
+	return n.checkDelivered(out.To, receivers)
+}
+
+// checkDelivered fails or warns when no subscriber received a message to
+// to. The warning is logged once until a message gets through again.
+func (n *Node) checkDelivered(to string, receivers int64) error {
+	n.peersMu.Lock()
+	warned := n.undelivered[to]
+	n.undelivered[to] = receivers <= 0
+	n.peersMu.Unlock()
+	if receivers > 0 {
+		return nil
+	}
+	if n.opts.RequireReceiver {
+		return fmt.Errorf("%w: nobody is subscribed to '%s'", ErrNoReceivers, to)
+	}
+	if !warned {
+		n.logger().WithField("peer", to).Warningf("Nobody is subscribed to %s: messages are being lost", to)
+	}
+	return nil
+}
+
+// WaitForReceiver waits until a node is subscribed to the channel to, or
+// ctx is done. A queue is ready at once, as its stream holds messages.
+func (n *Node) WaitForReceiver(ctx context.Context, to string) error {
+	self := int64(0)
+	if msgspec.IsGroup(to) && n.inGroup(to) {
+		self = 1
+	}
+	for {
+		queued, err := n.IsQueue(to)
+		if err == nil && queued {
+			return nil
+		}
+		counts, err := n.rdb.PubSubNumSub(ctx, to).Result()
+		if err == nil && counts[to] > self {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitReceiverPoll):
+		}
+	}
+}
+
+// Close leaves joined groups and queues, unregisters patterns, removes the
+// presence record, unregisters an ephemeral node, unsubscribes and releases
+// the Redis client if the node created it. The Receive channel is closed
+// once the receive loop has stopped.
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		n.leaveGroups()
+		n.leaveQueues()
+		n.unregisterPatterns()
+		if n.connected.Load() {
+			n.leavePresence()
+		}
+		if n.opts.Ephemeral {
+			n.unregisterPubkey()
+		}
+		n.cancel()
+		if n.pubsub != nil {
+			err = n.pubsub.Close()
+			n.wg.Wait()
+		}
+		if n.ownsRedis {
+			_ = n.rdb.Close()
+		}
+	})
+	return err
+}
+
+// unregisterPubkey removes the pubkey if the Crypto supports it.
+func (n *Node) unregisterPubkey() {
+	uc, ok := n.crypto.(interface {
+		UnregisterPubkey(ctx context.Context, chnName string) error
+	})
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := uc.UnregisterPubkey(ctx, n.Name)
+	if err != nil {
+		log.Debugln("Failed to unregister pubkey", err)
+	}
+}
+
+func (n *Node) receiveLoop() {
+	defer n.wg.Done()
+	defer close(n.recvCh)
+	remoteCh := n.pubsub.Channel()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case subMsg, ok := <-remoteCh:
+			if !ok {
+				return
+			}
+			msg := n.handle(subMsg.Channel, subMsg.Payload)
+			if msg == nil {
+				continue
+			}
+			select {
+			case n.recvCh <- msg:
+			case <-n.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// logger returns a logger with the name of this node.
+func (n *Node) logger() *log.Entry {
+	return log.WithField("node", n.Name)
+}
+
+// msgLog returns a logger with the fields of msg, see msgspec.LogFields.
+// The node is always this one, also for messages to a group.
+func (n *Node) msgLog(msg *msgspec.RpipeMsg, direction string) *log.Entry {
+	return log.WithFields(msg.LogFields(direction)).WithField("node", n.Name)
+}
+
+// handle parses and decrypts a message received on channel, from pub/sub
+// or a queue. It returns nil when the message was consumed or dropped.
+func (n *Node) handle(channel, payload string) *msgspec.RpipeMsg {
+	msg, err := msgspec.NewMsgFromBytes([]byte(payload))
+	if err != nil {
+		n.logger().WithField("channel", channel).Warningln("Failed to parse message from remote", err)
+		droppedMessages.WithLabelValues("parse").Inc()
+		return nil
+	}
+	msg.To = channel
+
+	n.msgLog(msg, msgspec.DirectionIn).Debugf("[SUB-%s] %s", msg.From, msg.Marshal())
+	if msg.Control == msgspec.ControlProbe {
+		if msg.From == n.Name {
+			n.probeReceived(string(msg.Data))
+		}
+		return nil
+	}
+	if msgspec.IsGroup(msg.To) && msg.From == n.Name {
+		// our own message to a group, echoed back by the subscription
+		return nil
+	}
+	if msgspec.IsGroup(msg.To) && !n.inGroup(msg.To) {
+		// a group matched by a pattern that we cannot read
+		droppedMessages.WithLabelValues("group").Inc()
+		return nil
+	}
+	n.addPeer(msg.From)
+
+	if msg.Control == msgspec.ControlResetSymkey {
+		err := n.crypto.ResetInboundSymkey(n.ctx, msg)
+		if err != nil {
+			n.msgLog(msg, msgspec.DirectionIn).Warningln("Failed to reset inbound Symkey", err)
+		}
+		if n.opts.OnControl != nil {
+			n.opts.OnControl(msg)
+		}
+		return nil
+	}
+
+	if msg.From == "" {
+		n.msgLog(msg, msgspec.DirectionIn).Warningln("Missing 'From' in message from remote")
+	}
+	if msg.Secured {
+		err := n.crypto.Open(n.ctx, msg)
+		if err != nil {
+			n.msgLog(msg, msgspec.DirectionIn).Warningln("Failed to decrypt, dropping message", err)
+			droppedMessages.WithLabelValues("decrypt").Inc()
+			if msg.To != n.Name && !msgspec.IsGroup(msg.To) {
+				n.requestRekey(msg)
+			}
+			return nil
+		}
+	}
+	messagesReceived.WithLabelValues(msg.From).Inc()
+	bytesReceived.WithLabelValues(msg.From).Add(float64(len(msg.Data)))
+	if msg.Control == msgspec.ControlHello {
+		hello := *msg
+		go n.answerHello(&hello)
+	}
+	if msg.Control != msgspec.ControlData && n.opts.OnControl != nil {
+		n.opts.OnControl(msg)
+	}
+	return msg
+}
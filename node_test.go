@@ -0,0 +1,71 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"github.com/sng2c/rpipe/msgspec"
+	"testing"
+	"time"
+)
+
+// unreachableNode returns a nonsecure node whose Redis refuses connections.
+func unreachableNode(t *testing.T, opts Options) *Node {
+	t.Helper()
+	opts.Nonsecure = true
+	n := &Node{Name: "alice", opts: opts, peers: make(map[string]bool), undelivered: make(map[string]bool), probes: make(map[string]chan struct{})}
+	n.rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		n.cancel()
+		_ = n.rdb.Close()
+	})
+	return n
+}
+
+func TestPublish_RetriesForWindow(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: 500 * time.Millisecond})
+	start := time.Now()
+	err := n.Publish(&msgspec.RpipeMsg{To: "bob", Data: []byte("hi")})
+	if err == nil {
+		t.Fatal("expected publish error")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("gave up after %s, expected retries for the window", elapsed)
+	}
+	if len(n.knownPeers()) != 0 {
+		t.Fatal("failed publish should not record a peer")
+	}
+}
+
+func TestPublish_NoRetry(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1})
+	start := time.Now()
+	if err := n.Publish(&msgspec.RpipeMsg{To: "bob", Data: []byte("hi")}); err == nil {
+		t.Fatal("expected publish error")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("expected no retries, took %s", elapsed)
+	}
+	if err := n.Publish(&msgspec.RpipeMsg{Data: []byte("hi")}); err != ErrNoTarget {
+		t.Fatalf("want ErrNoTarget, got %v", err)
+	}
+}
+
+func TestCheckDelivered(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	if err := n.checkDelivered("bob", 0); err != nil {
+		t.Fatalf("want a warning only, got %v", err)
+	}
+	if !n.undelivered["bob"] {
+		t.Fatal("expected bob to be marked undelivered")
+	}
+	if err := n.checkDelivered("bob", 1); err != nil || n.undelivered["bob"] {
+		t.Fatalf("delivery should clear the mark, got %v", err)
+	}
+
+	n.opts.RequireReceiver = true
+	if err := n.checkDelivered("bob", 0); !errors.Is(err, ErrNoReceivers) {
+		t.Fatalf("want ErrNoReceivers, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"sort"
+)
+
+var ErrPatternsUnsupported = errors.New("crypto does not support pattern subscriptions")
+
+// PatternCrypto is implemented by Crypto implementations that let senders
+// to any channel matching a pattern encrypt for the pattern's subscriber.
+type PatternCrypto interface {
+	RegisterPattern(ctx context.Context, pattern, owner string) error
+	UnregisterPattern(ctx context.Context, pattern string) error
+	// MatchingPatterns returns the patterns matching channel whose
+	// receiver is running.
+	MatchingPatterns(ctx context.Context, channel string) ([]string, error)
+}
+
+// SubscribePattern receives messages sent to every channel matching the
+// Redis glob pattern, e.g. 'logs.*'. Received messages keep the actual
+// channel in To and the sender in From.
+func (n *Node) SubscribePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("empty pattern")
+	}
+	pc, ok := n.crypto.(PatternCrypto)
+	if !ok {
+		return ErrPatternsUnsupported
+	}
+	err := pc.RegisterPattern(n.ctx, pattern, n.Name)
+	if err != nil {
+		return fmt.Errorf("register pattern '%s': %w", pattern, err)
+	}
+	err = n.pubsub.PSubscribe(n.ctx, pattern)
+	if err != nil {
+		return err
+	}
+	n.peersMu.Lock()
+	n.patterns[pattern] = true
+	n.peersMu.Unlock()
+	log.Debugf("Subscribed to pattern '%s'", pattern)
+	return nil
+}
+
+// Patterns returns the patterns this node subscribes to.
+func (n *Node) Patterns() []string {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	var patterns []string
+	for pattern := range n.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// receivesOn reports whether channel is this node's name or matches one
+// of its patterns. The node may send as any such channel, so replies to a
+// pattern sender come from the channel it wrote to.
+func (n *Node) receivesOn(channel string) bool {
+	if channel == n.Name {
+		return true
+	}
+	for _, pattern := range n.Patterns() {
+		if msgspec.MatchPattern(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// reregisterPatterns registers every pattern again after a reconnect.
+func (n *Node) reregisterPatterns() error {
+	pc, ok := n.crypto.(PatternCrypto)
+	if !ok {
+		return nil
+	}
+	for _, pattern := range n.Patterns() {
+		err := pc.RegisterPattern(n.ctx, pattern, n.Name)
+		if err != nil {
+			return fmt.Errorf("register pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// unregisterPatterns removes the registrations of this node's patterns on
+// Close, so that senders stop encrypting for it.
+func (n *Node) unregisterPatterns() {
+	pc, ok := n.crypto.(PatternCrypto)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	for _, pattern := range n.Patterns() {
+		err := pc.UnregisterPattern(ctx, pattern)
+		if err != nil {
+			log.Warningf("Failed to unregister pattern '%s': %v", pattern, err)
+		}
+	}
+}
+
+// requestRekey asks the sender of a message received on a pattern channel
+// to renegotiate its symkey, e.g. when Redis lost it.
+func (n *Node) requestRekey(msg *msgspec.RpipeMsg) {
+	resetMsg := msgspec.RpipeMsg{From: msg.To, To: msg.From, Control: msgspec.ControlResetSymkey}
+	err := n.rdb.Publish(n.ctx, msg.From, resetMsg.Marshal()).Err()
+	if err != nil {
+		n.msgLog(&resetMsg, msgspec.DirectionOut).Warningln("Failed to publish SYMKEYS reset to "+msg.From, err)
+	}
+}
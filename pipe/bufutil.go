@@ -3,6 +3,7 @@ package pipe
 import (
 	"bufio"
 	"bytes"
+	"context"
 	log "github.com/sirupsen/logrus"
 	"io"
 )
@@ -27,9 +28,15 @@ func FeedLines(buf []byte, atEOF bool) ([][]byte, []byte, error) {
 }
 
 func ReadLineChannel(rd io.Reader) <-chan []byte {
-	recvch := make(chan []byte)
+	return ReadLineChannelContext(context.Background(), rd)
+}
+
+// ReadLineChannelContext is ReadLineChannel, closing the channel once ctx
+// is done. A read in progress is abandoned.
+func ReadLineChannelContext(ctx context.Context, rd io.Reader) <-chan []byte {
+	readch := make(chan []byte)
 	go func() {
-		defer close(recvch)
+		defer close(readch)
 		reader := bufio.NewReader(rd)
 
 		for {
@@ -38,25 +45,81 @@ func ReadLineChannel(rd io.Reader) <-chan []byte {
 				log.Warningln(err)
 				break
 			}
-			recvch <- line
+			select {
+			case readch <- line:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
+	if ctx.Done() == nil {
+		return readch
+	}
 
+	recvch := make(chan []byte)
+	go func() {
+		defer close(recvch)
+		for {
+			select {
+			case line, ok := <-readch:
+				if !ok {
+					return
+				}
+				select {
+				case recvch <- line:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	return recvch
 }
 
 func ReadLineBufferChannel(rd io.Reader, blockSize int, delim byte) <-chan []byte {
-	recvch := make(chan []byte)
+	return ReadLineBufferChannelContext(context.Background(), rd, blockSize, delim)
+}
+
+// ReadLineBufferChannelContext is ReadLineBufferChannel, stopping once ctx
+// is done: what was read so far is still sent, including an incomplete
+// line, and the channel is closed. A read in progress is abandoned.
+func ReadLineBufferChannelContext(ctx context.Context, rd io.Reader, blockSize int, delim byte) <-chan []byte {
+	readch := make(chan []byte)
 	go func() {
-		defer close(recvch)
-		var full []byte
+		defer close(readch)
 		for {
 			buf := make([]byte, blockSize)
 			hasRead, err := rd.Read(buf)
+			if hasRead > 0 {
+				select {
+				case readch <- buf[:hasRead]:
+				case <-ctx.Done():
+					return
+				}
+			}
 			if err != nil {
 				break // EOF
 			}
-			full = append(full, buf[:hasRead]...)
+		}
+	}()
+
+	recvch := make(chan []byte)
+	go func() {
+		defer close(recvch)
+		var full []byte
+	ReadLoop:
+		for {
+			select {
+			case data, ok := <-readch:
+				if !ok {
+					break ReadLoop
+				}
+				full = append(full, data...)
+			case <-ctx.Done():
+				break ReadLoop
+			}
 
 			for {
 				found := bytes.IndexByte(full, delim)
@@ -74,31 +137,40 @@ func ReadLineBufferChannel(rd io.Reader, blockSize int, delim byte) <-chan []byt
 				}
 			}
 		}
-		if len(full) > 0 {
+		for len(full) > 0 {
 			//flush
-			recvch <- full
+			n := min(len(full), blockSize)
+			recvch <- full[:n]
+			full = full[n:]
 		}
 	}()
 	return recvch
 }
+
 func WriteLineChannel(wr io.Writer) chan<- []byte {
+	sendch, _ := WriteLineChannelDone(wr)
+	return sendch
+}
+
+// WriteLineChannelDone is WriteLineChannel, also returning a channel that
+// is closed once the returned channel is closed and everything sent on it
+// is written.
+func WriteLineChannelDone(wr io.Writer) (chan<- []byte, <-chan struct{}) {
 	sendch := make(chan []byte)
+	done := make(chan struct{})
 	go func() {
-		defer close(sendch)
+		defer close(done)
 		writer := bufio.NewWriter(wr)
-		for {
-			select {
-			case data := <-sendch:
-				_, err := writer.Write(data)
-				if err != nil {
-					log.Debug(err)
-				}
-				err = writer.Flush()
-				if err != nil {
-					log.Debug(err)
-				}
+		for data := range sendch {
+			_, err := writer.Write(data)
+			if err != nil {
+				log.Debug(err)
+			}
+			err = writer.Flush()
+			if err != nil {
+				log.Debug(err)
 			}
 		}
 	}()
-	return sendch
+	return sendch, done
 }
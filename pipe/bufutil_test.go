@@ -1,6 +1,9 @@
 package pipe
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"reflect"
 	"testing"
 )
@@ -56,3 +59,34 @@ func TestScanLines(t *testing.T) {
 		})
 	}
 }
+
+func TestReadLineBufferChannelContext(t *testing.T) {
+	rd, wr := io.Pipe()
+	defer wr.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ReadLineBufferChannelContext(ctx, rd, 16, '\n')
+	go func() { _, _ = wr.Write([]byte("AB\nCD")) }()
+
+	if got := string(<-ch); got != "AB\n" {
+		t.Fatalf("want the complete line, got %q", got)
+	}
+	cancel()
+	if got := string(<-ch); got != "CD" {
+		t.Fatalf("want the incomplete line flushed, got %q", got)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("want the channel closed")
+	}
+}
+
+func TestWriteLineChannelDone(t *testing.T) {
+	var buf bytes.Buffer
+	ch, done := WriteLineChannelDone(&buf)
+	ch <- []byte("a\n")
+	ch <- []byte("b")
+	close(ch)
+	<-done
+	if buf.String() != "a\nb" {
+		t.Fatalf("want everything written, got %q", buf.String())
+	}
+}
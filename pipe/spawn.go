@@ -3,6 +3,7 @@ package pipe
 import (
 	"context"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"os/exec"
 )
 
@@ -14,46 +15,81 @@ type SpawnedInfo struct {
 	CancelContext context.Context
 }
 
+// closeOnEOF closes the read end of a pipe once it has been read to the end.
+type closeOnEOF struct {
+	*os.File
+}
+
+func (f closeOnEOF) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil {
+		_ = f.File.Close()
+	}
+	return n, err
+}
+
+// Spawn starts cmd. Out and Err deliver its output until the command and
+// any process it passed them to have closed them, also after it exited,
+// and closing In closes its input. CancelContext is done once the command
+// has exited. The command is killed when ctx is done.
 func Spawn(ctx context.Context, cmd *exec.Cmd) (*SpawnedInfo, error) {
 
-	// STDOUT
-	outPipe, err := cmd.StdoutPipe()
+	// STDOUT and STDERR, which Wait must not close before they are read
+	outRead, outWrite, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
-	outChan := ReadLineChannel(outPipe)
-
-	// STDERR
-	errPipe, err := cmd.StderrPipe()
+	errRead, errWrite, err := os.Pipe()
 	if err != nil {
+		_ = outRead.Close()
+		_ = outWrite.Close()
 		return nil, err
 	}
-	errChan := ReadLineChannel(errPipe)
+	cmd.Stdout = outWrite
+	cmd.Stderr = errWrite
 
 	// STDIN
 	inPipe, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
-	inChan := WriteLineChannel(inPipe)
+
+	err = cmd.Start()
+	_ = outWrite.Close()
+	_ = errWrite.Close()
+	if err != nil {
+		_ = outRead.Close()
+		_ = errRead.Close()
+		return nil, err
+	}
+	outChan := ReadLineChannel(closeOnEOF{outRead})
+	errChan := ReadLineChannel(closeOnEOF{errRead})
+	inChan, inDone := WriteLineChannelDone(inPipe)
+	go func() {
+		// closing In sends EOF to the command
+		<-inDone
+		_ = inPipe.Close()
+	}()
 
 	cancelCtx, cancel := context.WithCancel(ctx)
+	exited := make(chan struct{})
 	go func() {
-		err = cmd.Run()
+		defer cancel()
+		err := cmd.Wait()
 		if err != nil {
 			log.Debugln(err)
 		}
-		go func() {
-			defer cancel()
-			_ = cmd.Wait()
-		}()
+		close(exited)
 		log.Debugln("Command exited.")
 	}()
 
 	go func() {
-		<-ctx.Done()
-		log.Debugln("Cancel context and KILL")
-		_ = cmd.Process.Kill()
+		select {
+		case <-ctx.Done():
+			log.Debugln("Cancel context and KILL")
+			_ = cmd.Process.Kill()
+		case <-exited:
+		}
 	}()
 
 	return &SpawnedInfo{cmd, inChan, outChan, errChan, cancelCtx}, nil
@@ -0,0 +1,274 @@
+package rpipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrTargetOffline = errors.New("target offline")
+
+// Every running node keeps a record in one Redis hash, refreshed each
+// PingInterval. A record past its expiry belongs to a node that died
+// without leaving; whoever finds it first removes it and announces the
+// leave. Joins and leaves are published on presenceEventsChannel.
+const (
+	presenceKey           = "RPIPE:PRESENCE"
+	presenceEventsChannel = "RPIPE:PRESENCE:EVENTS"
+	// presenceMisses is how many refreshes a node may miss before it is
+	// considered gone.
+	presenceMisses = 3
+	// onlineCheckTTL is how long a sender trusts that a target is not
+	// offline.
+	onlineCheckTTL = 2 * time.Second
+)
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// Presence describes a running node.
+type Presence struct {
+	Name        string    `json:"name"`
+	Host        string    `json:"host"`
+	Version     string    `json:"version"`
+	Mode        string    `json:"mode,omitempty"`
+	Started     time.Time `json:"started"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Ephemeral   bool      `json:"ephemeral,omitempty"`
+	Expires     time.Time `json:"expires"`
+}
+
+// PresenceEvent announces that a node joined or left.
+type PresenceEvent struct {
+	Event string   `json:"event"`
+	Peer  Presence `json:"peer"`
+}
+
+// Peers returns the live nodes, sorted by name. Expired records are
+// removed and their leave is announced.
+func Peers(ctx context.Context, rdb redis.UniversalClient) ([]Presence, error) {
+	records, err := rdb.HGetAll(ctx, presenceKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var peers []Presence
+	for name, record := range records {
+		var p Presence
+		err := json.Unmarshal([]byte(record), &p)
+		if err != nil {
+			log.Debugf("Ignoring presence record of %s: %v", name, err)
+			continue
+		}
+		if now.After(p.Expires) {
+			removePresence(ctx, rdb, p)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers, nil
+}
+
+// LookupPeer returns the presence record of the node called name, or nil
+// if it is not running.
+func LookupPeer(ctx context.Context, rdb redis.UniversalClient, name string) (*Presence, error) {
+	p, err := presenceRecord(ctx, rdb, name)
+	if err != nil || p == nil || time.Now().After(p.Expires) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// presenceRecord returns the record of name, expired or not, or nil if
+// there is none.
+func presenceRecord(ctx context.Context, rdb redis.UniversalClient, name string) (*Presence, error) {
+	record, err := rdb.HGet(ctx, presenceKey, name).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Presence
+	err = json.Unmarshal([]byte(record), &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// removePresence deletes the record of p and announces its leave, once
+// however many nodes try.
+func removePresence(ctx context.Context, rdb redis.UniversalClient, p Presence) {
+	removed, err := rdb.HDel(ctx, presenceKey, p.Name).Result()
+	if err != nil || removed == 0 {
+		return
+	}
+	publishPresence(ctx, rdb, PresenceEvent{Event: PresenceLeave, Peer: p})
+}
+
+func publishPresence(ctx context.Context, rdb redis.UniversalClient, event PresenceEvent) {
+	eventJson, _ := json.Marshal(event)
+	err := rdb.Publish(ctx, presenceEventsChannel, eventJson).Err()
+	if err != nil {
+		log.Debugf("Failed to announce %s of %s: %v", event.Event, event.Peer.Name, err)
+	}
+}
+
+// presence returns the current record of this node.
+func (n *Node) presence() Presence {
+	p := Presence{
+		Name:      n.Name,
+		Version:   Version,
+		Mode:      n.opts.Mode,
+		Started:   n.started,
+		Ephemeral: n.opts.Ephemeral,
+		Expires:   time.Now().Add(presenceMisses * n.opts.PingInterval),
+	}
+	p.Host, _ = os.Hostname()
+	if f, ok := n.crypto.(interface{ Fingerprint() string }); ok {
+		p.Fingerprint = f.Fingerprint()
+	}
+	return p
+}
+
+// refreshPresence writes this node's record, announcing a join when there
+// was none or when join is set, as a record left by a crashed node of the
+// same name may still be there.
+func (n *Node) refreshPresence(join bool) error {
+	p := n.presence()
+	record, _ := json.Marshal(p)
+	created, err := n.rdb.HSet(n.ctx, presenceKey, n.Name, record).Result()
+	if err != nil {
+		return err
+	}
+	if created > 0 || join {
+		publishPresence(n.ctx, n.rdb, PresenceEvent{Event: PresenceJoin, Peer: p})
+	}
+	return nil
+}
+
+// leavePresence removes this node's record on Close.
+func (n *Node) leavePresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	removePresence(ctx, n.rdb, n.presence())
+}
+
+// Peers returns the live nodes, see Peers.
+func (n *Node) Peers() ([]Presence, error) {
+	return Peers(n.ctx, n.rdb)
+}
+
+// WatchPresence delivers joins and leaves of other nodes until ctx is
+// done. Nodes that die without leaving are reported once their record
+// expires.
+func (n *Node) WatchPresence(ctx context.Context) <-chan PresenceEvent {
+	events := make(chan PresenceEvent)
+	sub := n.rdb.Subscribe(ctx, presenceEventsChannel)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		ticker := time.NewTicker(n.opts.PingInterval)
+		defer ticker.Stop()
+		subCh := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-n.ctx.Done():
+				return
+			case <-ticker.C:
+				// removes expired records, whose leaves then arrive on subCh
+				_, _ = Peers(ctx, n.rdb)
+			case subMsg, ok := <-subCh:
+				if !ok {
+					return
+				}
+				var event PresenceEvent
+				err := json.Unmarshal([]byte(subMsg.Payload), &event)
+				if err != nil || event.Peer.Name == n.Name {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				case <-n.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// checkOnline fails with ErrTargetOffline instead of publishing to no one:
+// when the presence record of to has expired, meaning it died without
+// leaving, or when there is no record, as for a node that left, and
+// nothing else listens on to, see hasListener. Groups are not checked.
+func (n *Node) checkOnline(to string) error {
+	if to == n.Name || msgspec.IsGroup(to) {
+		return nil
+	}
+	n.peersMu.Lock()
+	checkedAt, ok := n.onlineChecks[to]
+	n.peersMu.Unlock()
+	if ok && time.Since(checkedAt) < onlineCheckTTL {
+		return nil
+	}
+	p, err := presenceRecord(n.ctx, n.rdb, to)
+	if err != nil {
+		return err
+	}
+	if p != nil && time.Now().After(p.Expires) {
+		return fmt.Errorf("%w: '%s' is not running", ErrTargetOffline, to)
+	}
+	if p == nil {
+		listening, err := n.hasListener(to)
+		if err != nil {
+			return err
+		}
+		if !listening {
+			return fmt.Errorf("%w: '%s' is not running", ErrTargetOffline, to)
+		}
+	}
+	n.peersMu.Lock()
+	n.onlineChecks[to] = time.Now()
+	n.peersMu.Unlock()
+	return nil
+}
+
+// hasListener tells whether messages to a channel without a presence
+// record are received anyway: by a subscriber, such as a node older than
+// presence records, by a queue, or by a running pattern receiver.
+func (n *Node) hasListener(to string) (bool, error) {
+	counts, err := n.rdb.PubSubNumSub(n.ctx, to).Result()
+	if err != nil {
+		return false, err
+	}
+	if counts[to] > 0 {
+		return true, nil
+	}
+	queued, err := n.IsQueue(to)
+	if err != nil || queued {
+		return queued, err
+	}
+	if pc, ok := n.crypto.(PatternCrypto); ok {
+		patterns, err := pc.MatchingPatterns(n.ctx, to)
+		return len(patterns) > 0, err
+	}
+	// without registrations, any pattern subscriber might match
+	patterns, err := n.rdb.PubSubNumPat(n.ctx).Result()
+	return patterns > 0, err
+}
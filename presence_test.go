@@ -0,0 +1,111 @@
+package rpipe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOnline_NotChecked(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	// Redis is unreachable, so only names that are never looked up pass.
+	for _, to := range []string{"alice", "@ops"} {
+		if err := n.checkOnline(to); err != nil {
+			t.Errorf("checkOnline(%q) = %v, want nil", to, err)
+		}
+	}
+	if err := n.checkOnline("bob"); err == nil {
+		t.Error("checkOnline(\"bob\") = nil, want the Redis error")
+	}
+}
+
+// fakeRedis serves the commands checkOnline sends from replies, keyed by
+// the command line as go-redis sends it, e.g. "hget RPIPE:PRESENCE bob".
+// Other commands get a nil reply.
+func fakeRedis(t *testing.T, replies map[string]string) redis.UniversalClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					var argc int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &argc); err != nil {
+						return
+					}
+					args := make([]string, argc)
+					for i := range args {
+						var size int
+						if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+							return
+						}
+						arg := make([]byte, size+2)
+						if _, err := io.ReadFull(r, arg); err != nil {
+							return
+						}
+						args[i] = string(arg[:size])
+					}
+					reply, ok := replies[strings.Join(args, " ")]
+					if !ok {
+						reply = "$-1\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	rdb := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+		_ = listener.Close()
+	})
+	return rdb
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestCheckOnline(t *testing.T) {
+	live := bulk(fmt.Sprintf(`{"name":"bob","expires":%q}`, time.Now().Add(time.Minute).Format(time.RFC3339)))
+	expired := bulk(fmt.Sprintf(`{"name":"bob","expires":%q}`, time.Now().Add(-time.Minute).Format(time.RFC3339)))
+	noSubscribers := "*2\r\n" + bulk("bob") + ":0\r\n"
+	tests := []struct {
+		name    string
+		replies map[string]string
+		offline bool
+	}{
+		{"live", map[string]string{"hget RPIPE:PRESENCE bob": live}, false},
+		{"died", map[string]string{"hget RPIPE:PRESENCE bob": expired}, true},
+		{"left cleanly", map[string]string{"pubsub numsub bob": noSubscribers, "exists RPIPE:QUEUES:{bob}:INSTANCES": ":0\r\n", "pubsub numpat": ":0\r\n"}, true},
+		{"older node", map[string]string{"pubsub numsub bob": "*2\r\n" + bulk("bob") + ":1\r\n"}, false},
+		{"queue", map[string]string{"pubsub numsub bob": noSubscribers, "exists RPIPE:QUEUES:{bob}:INSTANCES": ":1\r\n"}, false},
+		{"pattern", map[string]string{"pubsub numsub bob": noSubscribers, "exists RPIPE:QUEUES:{bob}:INSTANCES": ":0\r\n", "pubsub numpat": ":1\r\n"}, false},
+	}
+	for _, tt := range tests {
+		n := &Node{Name: "alice", rdb: fakeRedis(t, tt.replies), queueChecks: make(map[string]queueCheck), onlineChecks: make(map[string]time.Time)}
+		n.ctx = context.Background()
+		err := n.checkOnline("bob")
+		if tt.offline && !errors.Is(err, ErrTargetOffline) || !tt.offline && err != nil {
+			t.Errorf("%s: checkOnline = %v, want offline %t", tt.name, err, tt.offline)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/secure"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrQueuesUnsupported = errors.New("crypto does not support queues")
+
+const (
+	// queueGroup is the consumer group every instance of a queue reads in.
+	queueGroup = "rpipe"
+	// queueMaxLen bounds the stream of a queue nobody is serving.
+	queueMaxLen = 100000
+	// queueReadBlock is how long one read waits for new messages.
+	queueReadBlock = time.Second
+	// queueMaintainInterval is how often an instance refreshes its
+	// heartbeat and looks for messages of dead instances.
+	queueMaintainInterval = time.Second
+	// queueClaimIdle is how long a message may stay unacknowledged by a
+	// silent instance before another one takes it over.
+	queueClaimIdle = 30 * time.Second
+	// queueCheckTTL is how long a sender trusts that a name is, or is not,
+	// a queue.
+	queueCheckTTL = 5 * time.Second
+)
+
+// QueueCrypto is implemented by Crypto implementations that let several
+// instances share the key of one service name.
+type QueueCrypto interface {
+	JoinQueue(ctx context.Context, service, instance string) error
+	MaintainQueue(ctx context.Context, service, instance string) error
+	LeaveQueue(ctx context.Context, service, instance string) error
+}
+
+type queueCheck struct {
+	isQueue bool
+	at      time.Time
+}
+
+// NewInstanceName returns a random instance name of service, e.g.
+// 'worker#3f2a9c01'.
+func NewInstanceName(service string) string {
+	return service + "#" + NewCallID()[:8]
+}
+
+// IsInstanceOf reports whether name is an instance name of service.
+func IsInstanceOf(name, service string) bool {
+	return strings.HasPrefix(name, service+"#") && len(name) > len(service)+1
+}
+
+// JoinQueue makes this node an instance of service. Each message sent to
+// service is then delivered to exactly one of its instances; replies go
+// out from the instance name. The node name must be an instance name of
+// service, see NewInstanceName.
+func (n *Node) JoinQueue(service string) error {
+	if !IsInstanceOf(n.Name, service) {
+		return fmt.Errorf("node name '%s' is not an instance name of '%s'", n.Name, service)
+	}
+	qc, ok := n.crypto.(QueueCrypto)
+	if !ok {
+		return ErrQueuesUnsupported
+	}
+	err := n.joinQueue(qc, service)
+	if err != nil {
+		return err
+	}
+	// resets from senders are published to the service name
+	err = n.pubsub.Subscribe(n.ctx, service)
+	if err != nil {
+		return err
+	}
+	n.peersMu.Lock()
+	n.queues[service] = true
+	n.peersMu.Unlock()
+	n.wg.Add(1)
+	go n.consumeQueue(qc, service)
+	log.Debugf("Serving queue %s as %s", service, n.Name)
+	return nil
+}
+
+func (n *Node) joinQueue(qc QueueCrypto, service string) error {
+	err := qc.JoinQueue(n.ctx, service, n.Name)
+	if err != nil {
+		return fmt.Errorf("join queue %s: %w", service, err)
+	}
+	err = n.rdb.XGroupCreateMkStream(n.ctx, secure.QueueKey(service, "STREAM"), queueGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// Queues returns the services this node is an instance of.
+func (n *Node) Queues() []string {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	var queues []string
+	for queue := range n.queues {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+func (n *Node) servesQueue(service string) bool {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	return n.queues[service]
+}
+
+// IsQueue reports whether to is a service served by queue instances. The
+// answer is cached for a few seconds.
+func (n *Node) IsQueue(to string) (bool, error) {
+	n.peersMu.Lock()
+	check, ok := n.queueChecks[to]
+	n.peersMu.Unlock()
+	if ok && time.Since(check.at) < queueCheckTTL {
+		return check.isQueue, nil
+	}
+	found, err := n.rdb.Exists(n.ctx, secure.QueueKey(to, "INSTANCES")).Result()
+	if err != nil {
+		return false, err
+	}
+	n.peersMu.Lock()
+	n.queueChecks[to] = queueCheck{isQueue: found > 0, at: time.Now()}
+	n.peersMu.Unlock()
+	return found > 0, nil
+}
+
+// publishQueued appends a sealed message to the stream of service.
+func (n *Node) publishQueued(service string, msgJson []byte) error {
+	return n.rdb.XAdd(n.ctx, &redis.XAddArgs{
+		Stream: secure.QueueKey(service, "STREAM"),
+		MaxLen: queueMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"msg": msgJson},
+	}).Err()
+}
+
+// consumeQueue reads the messages of service assigned to this instance.
+// A message is acknowledged once it is handed to Receive; messages left
+// unacknowledged by a dead instance are claimed after queueClaimIdle.
+func (n *Node) consumeQueue(qc QueueCrypto, service string) {
+	defer n.wg.Done()
+	stream := secure.QueueKey(service, "STREAM")
+	var maintainedAt time.Time
+	for n.ctx.Err() == nil && n.servesQueue(service) {
+		if time.Since(maintainedAt) >= queueMaintainInterval {
+			maintainedAt = time.Now()
+			err := qc.MaintainQueue(n.ctx, service, n.Name)
+			if err != nil && n.ctx.Err() == nil {
+				log.Warningf("Failed to maintain queue %s: %v", service, err)
+			}
+			n.claimIdle(service)
+		}
+		streams, err := n.rdb.XReadGroup(n.ctx, &redis.XReadGroupArgs{
+			Group:    queueGroup,
+			Consumer: n.Name,
+			Streams:  []string{stream, ">"},
+			Count:    16,
+			Block:    queueReadBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return
+			}
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// Redis lost the stream, resume will join again
+				log.Debugf("Queue %s has no consumer group", service)
+			} else {
+				log.Warningf("Failed to read queue %s: %v", service, err)
+			}
+			select {
+			case <-time.After(queueReadBlock):
+			case <-n.ctx.Done():
+				return
+			}
+			continue
+		}
+		for _, s := range streams {
+			for _, xmsg := range s.Messages {
+				if !n.deliverQueued(service, xmsg) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// claimIdle takes over messages another instance read but never
+// acknowledged, e.g. because it died.
+func (n *Node) claimIdle(service string) {
+	stream := secure.QueueKey(service, "STREAM")
+	pending, err := n.rdb.XPendingExt(n.ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  queueGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  16,
+	}).Result()
+	if err != nil {
+		return
+	}
+	var ids []string
+	for _, p := range pending {
+		if p.Idle >= queueClaimIdle && p.Consumer != n.Name {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	claimed, err := n.rdb.XClaim(n.ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    queueGroup,
+		Consumer: n.Name,
+		MinIdle:  queueClaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		log.Warningf("Failed to claim messages of %s: %v", service, err)
+		return
+	}
+	for _, xmsg := range claimed {
+		log.Debugf("Claimed %s of %s", xmsg.ID, service)
+		if !n.deliverQueued(service, xmsg) {
+			return
+		}
+	}
+}
+
+// deliverQueued hands a stream entry to Receive and acknowledges it. It
+// returns false if the node closed first.
+func (n *Node) deliverQueued(service string, xmsg redis.XMessage) bool {
+	if ms, err := strconv.ParseInt(strings.SplitN(xmsg.ID, "-", 2)[0], 10, 64); err == nil {
+		// stream ids start with the time the message was added
+		queueLatency.Observe(time.Since(time.UnixMilli(ms)).Seconds())
+	}
+	payload, _ := xmsg.Values["msg"].(string)
+	msg := n.handle(service, payload)
+	if msg != nil {
+		select {
+		case n.recvCh <- msg:
+		case <-n.ctx.Done():
+			return false
+		}
+	}
+	err := n.rdb.XAck(n.ctx, secure.QueueKey(service, "STREAM"), queueGroup, xmsg.ID).Err()
+	if err != nil {
+		log.Warningf("Failed to ack %s of %s: %v", xmsg.ID, service, err)
+	}
+	return true
+}
+
+// leaveQueues stops serving every queue. Messages still unacknowledged
+// by this instance are claimed by the others.
+func (n *Node) leaveQueues() {
+	qc, ok := n.crypto.(QueueCrypto)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	for _, service := range n.Queues() {
+		n.peersMu.Lock()
+		delete(n.queues, service)
+		n.peersMu.Unlock()
+		err := qc.LeaveQueue(ctx, service, n.Name)
+		if err != nil {
+			log.Warningf("Failed to leave queue %s: %v", service, err)
+		}
+		stream := secure.QueueKey(service, "STREAM")
+		pending, err := n.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    queueGroup,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: n.Name,
+		}).Result()
+		if err == nil && len(pending) == 0 {
+			_ = n.rdb.XGroupDelConsumer(ctx, stream, queueGroup, n.Name).Err()
+		}
+	}
+}
+
+// rejoinQueues joins every queue again after a reconnect.
+func (n *Node) rejoinQueues() error {
+	qc, ok := n.crypto.(QueueCrypto)
+	if !ok {
+		return nil
+	}
+	for _, service := range n.Queues() {
+		err := n.joinQueue(qc, service)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
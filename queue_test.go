@@ -0,0 +1,24 @@
+package rpipe
+
+import "testing"
+
+func TestIsInstanceOf(t *testing.T) {
+	tests := []struct {
+		name, service string
+		want          bool
+	}{
+		{"worker#3f2a9c01", "worker", true},
+		{"worker", "worker", false},
+		{"worker#", "worker", false},
+		{"workers#1", "worker", false},
+		{"worker#1", "work", false},
+	}
+	for _, tt := range tests {
+		if got := IsInstanceOf(tt.name, tt.service); got != tt.want {
+			t.Errorf("IsInstanceOf(%q, %q) = %v, want %v", tt.name, tt.service, got, tt.want)
+		}
+	}
+	if name := NewInstanceName("worker"); !IsInstanceOf(name, "worker") {
+		t.Errorf("NewInstanceName returned %q", name)
+	}
+}
@@ -0,0 +1,143 @@
+package rpipe
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const DefaultRedisURL = "redis://localhost:6379/0"
+
+const (
+	SchemeRedis         = "redis"
+	SchemeRediss        = "rediss"
+	SchemeRedisSentinel = "redis-sentinel"
+	SchemeRedisCluster  = "redis-cluster"
+)
+
+// RedisOptions is a parsed Redis URL.
+type RedisOptions struct {
+	Scheme string
+	// TLS is set by rediss:// or the tls=true query parameter.
+	TLS bool
+	redis.UniversalOptions
+}
+
+// ParseRedisURL parses one of
+//
+//	redis://[user:password@]host:port/db
+//	rediss://[user:password@]host:port/db
+//	redis-sentinel://[user:password@]host:port[,host:port...]/master[/db][?sentinel_password=...]
+//	redis-cluster://[user:password@]host:port[,host:port...]
+//
+// The sentinel and cluster forms accept tls=true to connect over TLS.
+func ParseRedisURL(redisURL string) (*RedisOptions, error) {
+	redisAddr, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL, expected format: redis://[user:password@]host:port/db: %w", err)
+	}
+	opts := &RedisOptions{Scheme: redisAddr.Scheme}
+	opts.Username = redisAddr.User.Username()
+	opts.Password, _ = redisAddr.User.Password()
+	opts.Addrs = strings.Split(redisAddr.Host, ",")
+	for _, addr := range opts.Addrs {
+		if addr == "" {
+			return nil, fmt.Errorf("invalid Redis URL '%s': empty host", redisURL)
+		}
+	}
+	redisPath := strings.Trim(redisAddr.Path, "/")
+
+	switch opts.Scheme {
+	case SchemeRedis, SchemeRediss:
+		opts.TLS = opts.Scheme == SchemeRediss
+		if len(opts.Addrs) > 1 {
+			return nil, fmt.Errorf("redis:// takes a single host, use redis-cluster:// or redis-sentinel:// for several")
+		}
+		opts.DB, err = parseRedisDB(redisPath)
+		if err != nil {
+			return nil, err
+		}
+	case SchemeRedisSentinel:
+		master, db, _ := strings.Cut(redisPath, "/")
+		if master == "" {
+			return nil, fmt.Errorf("redis-sentinel:// requires a master name: redis-sentinel://host:port/master/db")
+		}
+		opts.MasterName = master
+		opts.DB, err = parseRedisDB(db)
+		if err != nil {
+			return nil, err
+		}
+		opts.SentinelPassword = redisAddr.Query().Get("sentinel_password")
+	case SchemeRedisCluster:
+		if redisPath != "" {
+			return nil, fmt.Errorf("redis-cluster:// does not support a DB index")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Redis URL scheme '%s'", opts.Scheme)
+	}
+	if tlsParam := redisAddr.Query().Get("tls"); tlsParam != "" {
+		if opts.Scheme == SchemeRedis || opts.Scheme == SchemeRediss {
+			return nil, fmt.Errorf("use rediss:// instead of the tls parameter")
+		}
+		opts.TLS, err = strconv.ParseBool(tlsParam)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls parameter '%s': %w", tlsParam, err)
+		}
+	}
+	return opts, nil
+}
+
+func parseRedisDB(redisPath string) (int, error) {
+	if redisPath == "" {
+		return 0, nil
+	}
+	db, err := strconv.Atoi(redisPath)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Redis DB index '%s': must be a number", redisPath)
+	}
+	return db, nil
+}
+
+// NewClient creates a standalone, Sentinel failover or Cluster client.
+// Pub/sub on the failover and cluster clients re-resolves the serving node
+// when it reconnects, so subscriptions follow a failover.
+func (o *RedisOptions) NewClient() redis.UniversalClient {
+	switch o.Scheme {
+	case SchemeRedisSentinel:
+		return redis.NewFailoverClient(o.Failover())
+	case SchemeRedisCluster:
+		return redis.NewClusterClient(o.Cluster())
+	default:
+		return redis.NewClient(o.Simple())
+	}
+}
+
+// SetTLS builds the TLS configuration for a TLS URL. TLS options on a
+// plaintext URL are an error rather than being silently ignored.
+func (o *RedisOptions) SetTLS(tlsOpts *TLSOptions) error {
+	if !o.TLS {
+		if !tlsOpts.isZero() {
+			return fmt.Errorf("TLS options given for a plaintext %s:// URL, use rediss:// or tls=true", o.Scheme)
+		}
+		return nil
+	}
+	var err error
+	o.TLSConfig, err = tlsOpts.Config()
+	return err
+}
+
+// NewRedisClient parses redisURL and creates a matching client.
+// tlsOpts may be nil.
+func NewRedisClient(redisURL string, tlsOpts *TLSOptions) (redis.UniversalClient, error) {
+	opts, err := ParseRedisURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.SetTLS(tlsOpts)
+	if err != nil {
+		return nil, err
+	}
+	return opts.NewClient(), nil
+}
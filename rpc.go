@@ -0,0 +1,138 @@
+package rpipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"os"
+)
+
+var ErrNodeClosed = errors.New("node closed")
+
+// NewCallID returns a random correlation id.
+func NewCallID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Call sends payload to the RPC server to and waits for the reply with the
+// same correlation id, until ctx is done. If to is a queue, the reply
+// comes from whichever instance took the call. It reads the Receive
+// channel and drops everything else, so it suits a node dedicated to
+// calls; replies to other calls, e.g. of a timed out earlier call, are
+// ignored.
+func (n *Node) Call(ctx context.Context, to string, payload []byte) ([]byte, error) {
+	cid := NewCallID()
+	err := n.Publish(&msgspec.RpipeMsg{To: to, Control: msgspec.ControlCall, Cid: cid, Data: payload})
+	if err != nil {
+		return nil, err
+	}
+	remoteCh := n.Receive()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case msg, ok := <-remoteCh:
+			if !ok {
+				return nil, ErrNodeClosed
+			}
+			if msg.Control != msgspec.ControlReply || msg.Cid != cid || (msg.From != to && !IsInstanceOf(msg.From, to)) {
+				n.msgLog(msg, msgspec.DirectionIn).Debugf("Ignoring message from %s: not the reply to %s", msg.From, cid)
+				continue
+			}
+			return msg.Data, nil
+		}
+	}
+}
+
+type RPCServerOptions struct {
+	// In carries response lines, e.g. from a spawned command's stdout.
+	// RPCServer.Run returns when it closes.
+	In <-chan []byte
+	// Err carries local diagnostics, copied to os.Stderr.
+	Err <-chan []byte
+	// Out receives one line per request payload.
+	Out chan<- []byte
+}
+
+// RPCServer answers calls with a line oriented local process: each request
+// payload is written to Out as a line, and each line read from In answers
+// the oldest unanswered request, tagged with its correlation id.
+type RPCServer struct {
+	node    *Node
+	opts    RPCServerOptions
+	pending []*msgspec.RpipeMsg
+}
+
+func NewRPCServer(node *Node, opts RPCServerOptions) *RPCServer {
+	return &RPCServer{node: node, opts: opts}
+}
+
+// Run serves until local input closes or ctx is cancelled.
+func (s *RPCServer) Run(ctx context.Context) error {
+	fromLocalCh := s.opts.In
+	fromLocalErrorCh := s.opts.Err
+	remoteCh := s.node.Receive()
+
+MainLoop:
+	for {
+		select {
+		case data, ok := <-fromLocalErrorCh:
+			if ok == false {
+				log.Debugf("fromLocalErrorCh is closed\n")
+				break MainLoop
+			}
+			_, _ = os.Stderr.Write(data)
+
+		case line, ok := <-fromLocalCh:
+			if ok == false {
+				log.Debugf("fromLocalCh is closed\n")
+				break MainLoop
+			}
+			s.reply(line)
+
+		case <-ctx.Done():
+			break MainLoop
+
+		case msg, ok := <-remoteCh:
+			if ok == false {
+				log.Debugf("remoteCh is closed\n")
+				break MainLoop
+			}
+			if msg.Control != msgspec.ControlCall {
+				s.node.msgLog(msg, msgspec.DirectionIn).Debugf("Ignoring message from %s: not a call", msg.From)
+				continue MainLoop
+			}
+			s.node.msgLog(msg, msgspec.DirectionIn).Debugf("Call %s from %s", msg.Cid, msg.From)
+			s.pending = append(s.pending, msg)
+			payload := bytes.TrimRight(msg.Data, "\n")
+			select {
+			case s.opts.Out <- append(payload, '\n'):
+			case <-ctx.Done():
+				break MainLoop
+			}
+		}
+	}
+	for _, call := range s.pending {
+		s.node.msgLog(call, msgspec.DirectionIn).Warningf("Call %s from %s left unanswered", call.Cid, call.From)
+	}
+	return nil
+}
+
+func (s *RPCServer) reply(line []byte) {
+	if len(s.pending) == 0 {
+		log.Warningf("Dropping output line without a pending call: %s", bytes.TrimRight(line, "\n"))
+		return
+	}
+	call := s.pending[0]
+	s.pending = s.pending[1:]
+	err := s.node.Publish(&msgspec.RpipeMsg{To: call.From, Control: msgspec.ControlReply, Cid: call.Cid, Data: bytes.TrimRight(line, "\n")})
+	if err != nil {
+		s.node.msgLog(call, msgspec.DirectionIn).Warningf("Failed to reply to call %s from %s: %v", call.Cid, call.From, err)
+	}
+}
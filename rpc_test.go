@@ -0,0 +1,27 @@
+package rpipe
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewCallID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := NewCallID()
+		if len(id) != 16 || seen[id] {
+			t.Fatalf("unexpected call id %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCall_PublishError(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := n.Call(ctx, "agent", []byte("status")); err == nil || ctx.Err() != nil {
+		t.Fatalf("want the publish error before the timeout, got %v", err)
+	}
+}
@@ -16,40 +16,70 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/sng2c/rpipe/msgspec"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var ExpireError = errors.New("SymKey has expired")
+var NoPubkeyError = errors.New("no pubkey registered")
+var PubkeyMismatchError = errors.New("registered pubkey does not match the private key")
 
 const symkeyTTL = 1 * time.Hour
 
 type Cryptor struct {
 	PrivateKey *rsa.PrivateKey
-	rdb        *redis.Client
+	rdb        redis.UniversalClient
+	mu         sync.Mutex
 	cache      map[string]*SymKey
+	generation map[string]int64           // symkey name -> keys used for it so far
+	groups     map[string]map[string]bool // group -> member names it was joined as
+	services   map[string]*rsa.PrivateKey
 }
 type SymKey struct {
 	Key []byte
+
+	since time.Time
+}
+
+// SymkeyInfo describes a cached symkey. Name is 'FROM:TO' for the key of
+// one direction between two nodes, or the group. Epoch is the group key
+// epoch, or how many keys this cryptor has used for the direction.
+type SymkeyInfo struct {
+	Name  string    `json:"name"`
+	Epoch int64     `json:"epoch"`
+	Since time.Time `json:"since"`
 }
 
-func NewCryptor(rdb *redis.Client) *Cryptor {
+func NewCryptor(rdb redis.UniversalClient) *Cryptor {
 	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	// clear SYMKEYS
 	return &Cryptor{
 		PrivateKey: privateKey,
 		rdb:        rdb,
 		cache:      make(map[string]*SymKey),
+		generation: make(map[string]int64),
+		groups:     make(map[string]map[string]bool),
+		services:   make(map[string]*rsa.PrivateKey),
 	}
 }
+
+// msgLog returns a logger with the fields of msg, see msgspec.LogFields.
+func msgLog(msg *msgspec.RpipeMsg, direction string) *log.Entry {
+	return log.WithFields(msg.LogFields(direction))
+}
+
 func (c *Cryptor) ResetInboundSymkey(ctx context.Context, msg *msgspec.RpipeMsg) error {
-	log.Debugf("Expire SYMKEY for %s\n", msg.SymkeyName())
-	delete(c.cache, msg.SymkeyName())
+	msgLog(msg, msgspec.DirectionIn).Debugf("Expire SYMKEY for %s", msg.SymkeyName())
+	symkeyResets.Inc()
+	c.InvalidateSymkey(msg)
 
 	// 반대쪽 symm 을 다시 말아준다.`
 	msgrev := msg.NewReturnMsg()
 	_, err := c.RegisterNewOutboundSymkey(ctx, msgrev)
-	log.Debugf("Register SYMKEY for %s\n", msgrev.SymkeyName())
+	msgLog(msgrev, msgspec.DirectionOut).Debugf("Register SYMKEY for %s", msgrev.SymkeyName())
 	if err != nil {
 		return err
 	}
@@ -69,7 +99,7 @@ func (c *Cryptor) RegisterPubkey(ctx context.Context, chnName string) error {
 
 	// Delete Symkeys from ME
 	{
-		keys, err := c.rdb.Keys(ctx, "RPIPE:SYMKEYS:"+chnName+":*").Result()
+		keys, err := c.keys(ctx, "RPIPE:SYMKEYS:"+chnName+":*")
 		log.Debugf("Remove Keys %v\n", keys)
 		if err != nil {
 			return err
@@ -88,7 +118,7 @@ func (c *Cryptor) RegisterPubkey(ctx context.Context, chnName string) error {
 
 	// Publish Reset Symkeys to ME
 	{
-		keys, err := c.rdb.Keys(ctx, "RPIPE:SYMKEYS:*:"+chnName).Result()
+		keys, err := c.keys(ctx, "RPIPE:SYMKEYS:*:"+chnName)
 		log.Debugln("KEYS RPIPE:SYMKEYS:*:" + chnName + "\n")
 		log.Debugf("Publish Reset SYMKEYS %v\n", keys)
 		if err != nil {
@@ -102,20 +132,61 @@ func (c *Cryptor) RegisterPubkey(ctx context.Context, chnName string) error {
 	}
 
 	for targetChnName := range resetTargets {
-		resetMsg := msgspec.RpipeMsg{From: chnName, To: targetChnName, Control: 1}
+		resetMsg := msgspec.RpipeMsg{From: chnName, To: targetChnName, Control: msgspec.ControlResetSymkey}
 		resetMsgJson := resetMsg.Marshal()
-		log.Debugf("[PUB-%s] %s", targetChnName, resetMsgJson)
+		msgLog(&resetMsg, msgspec.DirectionOut).Debugf("[PUB-%s] %s", targetChnName, resetMsgJson)
 		_, err := c.rdb.Publish(ctx, targetChnName, resetMsgJson).Result()
 		if err != nil {
-			log.Warningln("Failed to publish SYMKEYS reset to "+targetChnName, err)
+			msgLog(&resetMsg, msgspec.DirectionOut).Warningln("Failed to publish SYMKEYS reset", err)
 			return err
 		}
 	}
 
 	return nil
 }
+
+// keys runs KEYS on every master when connected to a Redis Cluster,
+// since each master only knows the keys of its own slots.
+func (c *Cryptor) keys(ctx context.Context, pattern string) ([]string, error) {
+	cluster, ok := c.rdb.(*redis.ClusterClient)
+	if !ok {
+		return c.rdb.Keys(ctx, pattern).Result()
+	}
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		nodeKeys, err := master.Keys(ctx, pattern).Result()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return nil
+	})
+	return keys, err
+}
+
+// FetchTargetPubkey returns the pubkey of msg.To, or of a pattern receiver
+// subscribed to it when no node has that exact name.
 func (c *Cryptor) FetchTargetPubkey(ctx context.Context, msg *msgspec.RpipeMsg) (*rsa.PublicKey, error) {
 	result, err := c.rdb.Get(ctx, "RPIPE:PUBKEYS:"+msg.To).Result()
+	if err == redis.Nil {
+		result, err = c.fetchPatternPubkey(ctx, msg.To)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodePubkey(result), nil
+}
+
+// fetchNodePubkey returns the pubkey registered by the node named name,
+// ignoring pattern receivers.
+func (c *Cryptor) fetchNodePubkey(ctx context.Context, name string) (*rsa.PublicKey, error) {
+	result, err := c.rdb.Get(ctx, "RPIPE:PUBKEYS:"+name).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w for '%s': is it running?", NoPubkeyError, name)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -123,11 +194,88 @@ func (c *Cryptor) FetchTargetPubkey(ctx context.Context, msg *msgspec.RpipeMsg)
 }
 
 func (c *Cryptor) InvalidateSymkey(msg *msgspec.RpipeMsg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.cache, msg.SymkeyName())
 }
 
+// ClearSymkeys drops every cached symkey, e.g. after Redis lost its data.
+func (c *Cryptor) ClearSymkeys() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache = make(map[string]*SymKey)
+}
+
+// VerifyPubkey checks that the pubkey registered for chnName is the one
+// of this cryptor's private key, and not one left by another process.
+func (c *Cryptor) VerifyPubkey(ctx context.Context, chnName string) error {
+	pubkey, err := c.fetchNodePubkey(ctx, chnName)
+	if err != nil {
+		return err
+	}
+	if !pubkey.Equal(&c.PrivateKey.PublicKey) {
+		return fmt.Errorf("%w: '%s' is registered with %s", PubkeyMismatchError, chnName, PubkeyFingerprint(pubkey))
+	}
+	return nil
+}
+
+// UnregisterPubkey removes the pubkey of chnName, e.g. for a node with a
+// generated name that will not be used again.
+func (c *Cryptor) UnregisterPubkey(ctx context.Context, chnName string) error {
+	return c.rdb.Del(ctx, "RPIPE:PUBKEYS:"+chnName).Err()
+}
+
+// PubkeyRegistered reports whether the pubkey for chnName is still in Redis.
+func (c *Cryptor) PubkeyRegistered(ctx context.Context, chnName string) (bool, error) {
+	n, err := c.rdb.Exists(ctx, "RPIPE:PUBKEYS:"+chnName).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (c *Cryptor) cached(name string) (*SymKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	symKey, ok := c.cache[name]
+	return symKey, ok
+}
+
+func (c *Cryptor) store(name string, symKey *SymKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	symKey.since = time.Now()
+	c.cache[name] = symKey
+	if c.generation == nil {
+		c.generation = make(map[string]int64)
+	}
+	c.generation[name]++
+}
+
+// Symkeys lists the cached symkeys, sorted by name and epoch.
+func (c *Cryptor) Symkeys() []SymkeyInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var infos []SymkeyInfo
+	for name, symKey := range c.cache {
+		info := SymkeyInfo{Name: name, Epoch: c.generation[name], Since: symKey.since}
+		if group, epoch, ok := strings.Cut(name, "#"); ok && msgspec.IsGroup(group) {
+			info.Name = group
+			info.Epoch, _ = strconv.ParseInt(epoch, 10, 64)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Epoch < infos[j].Epoch
+	})
+	return infos
+}
+
 func (c *Cryptor) FetchSymkey(ctx context.Context, msg *msgspec.RpipeMsg) (*SymKey, error) {
-	symKey, ok := c.cache[msg.SymkeyName()]
+	symKey, ok := c.cached(msg.SymkeyName())
 	if !ok {
 		symkeyFullname := fmt.Sprintf("RPIPE:SYMKEYS:%s", msg.SymkeyName())
 		log.Debugf("Update Symkey %s\n", symkeyFullname)
@@ -135,12 +283,12 @@ func (c *Cryptor) FetchSymkey(ctx context.Context, msg *msgspec.RpipeMsg) (*SymK
 		if err != nil {
 			return nil, ExpireError
 		}
-		_key, err := DecryptPKI(c.PrivateKey, pkiCryptedSymkey)
+		_key, err := DecryptPKI(c.privateKeyFor(msg.To), pkiCryptedSymkey)
 		if err != nil {
 			return nil, err
 		}
 		symKey = &SymKey{Key: _key}
-		c.cache[msg.SymkeyName()] = symKey
+		c.store(msg.SymkeyName(), symKey)
 	}
 	return symKey, nil
 }
@@ -157,7 +305,8 @@ func randStringBytes(n int) []byte {
 // RotateOutboundSymkey notifies the receiver to reset its inbound cache (Control=1),
 // then registers a new outbound symkey. Use this when a symkey expires.
 func (c *Cryptor) RotateOutboundSymkey(ctx context.Context, msg *msgspec.RpipeMsg) (*SymKey, error) {
-	resetMsg := msgspec.RpipeMsg{From: msg.From, To: msg.To, Control: 1}
+	symkeyRotations.Inc()
+	resetMsg := msgspec.RpipeMsg{From: msg.From, To: msg.To, Control: msgspec.ControlResetSymkey}
 	_, err := c.rdb.Publish(ctx, msg.To, resetMsg.Marshal()).Result()
 	if err != nil {
 		return nil, err
@@ -183,10 +332,67 @@ func (c *Cryptor) RegisterNewOutboundSymkey(ctx context.Context, msg *msgspec.Rp
 	symkey := SymKey{
 		Key: newKey,
 	}
-	c.cache[msg.SymkeyName()] = &symkey
+	c.store(msg.SymkeyName(), &symkey)
 	return &symkey, nil
 }
 
+// Seal encrypts msg.Data in place with the outbound symkey for msg,
+// rotating the symkey first if it has expired. Messages to a group are
+// sealed with the group's current key instead.
+func (c *Cryptor) Seal(ctx context.Context, msg *msgspec.RpipeMsg) error {
+	if msgspec.IsGroup(msg.To) {
+		return c.sealGroup(ctx, msg)
+	}
+	symKey, err := c.FetchSymkey(ctx, msg)
+	if err != nil {
+		if err != ExpireError {
+			return fmt.Errorf("fetch symkey: %w", err)
+		}
+		msgLog(msg, msgspec.DirectionOut).Debugln("Rotating Symkey", msg.SymkeyName())
+		symKey, err = c.RotateOutboundSymkey(ctx, msg)
+		if err != nil {
+			return fmt.Errorf("rotate symkey: %w", err)
+		}
+	}
+	cryptedData, err := EncryptMessage(symKey, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Data = cryptedData
+	msg.Secured = true
+	return nil
+}
+
+// Open decrypts msg.Data in place with the inbound symkey for msg.
+// If decryption fails (e.g. during a rotation race) the cached symkey is
+// invalidated and re-fetched from Redis once.
+func (c *Cryptor) Open(ctx context.Context, msg *msgspec.RpipeMsg) error {
+	if msgspec.IsGroup(msg.To) {
+		return c.openGroup(ctx, msg)
+	}
+	symKey, err := c.FetchSymkey(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("fetch symkey: %w", err)
+	}
+	decryptedData, err := DecryptMessage(symKey, msg.Data)
+	if err != nil {
+		msgLog(msg, msgspec.DirectionIn).Warningln("Decrypt failed, retrying with fresh symkey", err)
+		decryptRetries.Inc()
+		c.InvalidateSymkey(msg)
+		symKey, err = c.FetchSymkey(ctx, msg)
+		if err == nil {
+			decryptedData, err = DecryptMessage(symKey, msg.Data)
+		}
+		if err != nil {
+			decryptFailures.WithLabelValues(msg.From).Inc()
+			return fmt.Errorf("decrypt after retry: %w", err)
+		}
+	}
+	msg.Data = decryptedData
+	msg.Secured = false
+	return nil
+}
+
 func EncryptMessage(symKey *SymKey, message []byte) ([]byte, error) {
 	block, err := aes.NewCipher(symKey.Key)
 	if err != nil {
@@ -262,3 +468,16 @@ func DecodePrivkey(pemEncoded string) *rsa.PrivateKey {
 	privateKey, _ := x509.ParsePKCS1PrivateKey(x509Encoded)
 	return privateKey
 }
+
+// PubkeyFingerprint returns the SHA-256 fingerprint of a pubkey in the
+// form 'SHA256:<base64>', as ssh-keygen prints it.
+func PubkeyFingerprint(publicKey *rsa.PublicKey) string {
+	x509EncodedPub, _ := x509.MarshalPKIXPublicKey(publicKey)
+	sum := sha256.Sum256(x509EncodedPub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Fingerprint returns the fingerprint of this cryptor's pubkey.
+func (c *Cryptor) Fingerprint() string {
+	return PubkeyFingerprint(&c.PrivateKey.PublicKey)
+}
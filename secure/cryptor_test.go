@@ -2,8 +2,11 @@ package secure
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/sng2c/rpipe/msgspec"
@@ -144,3 +147,107 @@ func TestInvalidateSymkey_ClearsCache(t *testing.T) {
 		t.Fatal("expected cache entry to be removed after InvalidateSymkey")
 	}
 }
+
+func TestSymkeys(t *testing.T) {
+	c := &Cryptor{cache: make(map[string]*SymKey)}
+	c.store("alice:bob", &SymKey{Key: make([]byte, 32)})
+	c.store("alice:bob", &SymKey{Key: make([]byte, 32)})
+	c.store(groupCacheName("@ops", 7), &SymKey{Key: make([]byte, 32)})
+
+	infos := c.Symkeys()
+	if len(infos) != 2 {
+		t.Fatalf("want 2 symkeys, got %+v", infos)
+	}
+	if infos[0].Name != "@ops" || infos[0].Epoch != 7 {
+		t.Errorf("want the group epoch, got %+v", infos[0])
+	}
+	if infos[1].Name != "alice:bob" || infos[1].Epoch != 2 || infos[1].Since.IsZero() {
+		t.Errorf("want the second key of alice:bob, got %+v", infos[1])
+	}
+}
+
+// --- Groups ---
+
+func TestGroupSealOpen_CachedKey(t *testing.T) {
+	c := &Cryptor{cache: make(map[string]*SymKey), groups: map[string]map[string]bool{"@ops": {"alice": true}}}
+	c.cache[groupCacheName("@ops", 3)] = &SymKey{Key: make([]byte, 32)}
+
+	msg := &msgspec.RpipeMsg{From: "alice", To: "@ops", Data: []byte("deploy done"), Epoch: 3}
+	sealed, err := EncryptMessage(c.cache[groupCacheName("@ops", 3)], msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Data, msg.Secured = sealed, true
+	if err := c.Open(context.Background(), msg); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if string(msg.Data) != "deploy done" || msg.Secured {
+		t.Fatalf("unexpected message after Open: %+v", msg)
+	}
+}
+
+func TestGroupSeal_NotMember(t *testing.T) {
+	c := &Cryptor{cache: make(map[string]*SymKey), groups: make(map[string]map[string]bool)}
+	err := c.Seal(context.Background(), &msgspec.RpipeMsg{From: "alice", To: "@ops", Data: []byte("hi")})
+	if !errors.Is(err, NotMemberError) {
+		t.Fatalf("want NotMemberError, got %v", err)
+	}
+}
+
+func TestGroupMember_Shared(t *testing.T) {
+	// two bridges of a daemon joined @ops with one cryptor
+	c := &Cryptor{groups: map[string]map[string]bool{"@ops": {"web1": true, "web2": true}}}
+	if member, err := c.groupMember("@ops"); err != nil || member != "web1" {
+		t.Fatalf("want web1, got %q (%v)", member, err)
+	}
+	delete(c.groups["@ops"], "web1")
+	if member, err := c.groupMember("@ops"); err != nil || member != "web2" {
+		t.Fatalf("want web2 after web1 left, got %q (%v)", member, err)
+	}
+	delete(c.groups["@ops"], "web2")
+	if _, err := c.groupMember("@ops"); !errors.Is(err, NotMemberError) {
+		t.Fatalf("want NotMemberError, got %v", err)
+	}
+}
+
+func TestGroupRedisKey_SameSlot(t *testing.T) {
+	// All keys of a group share the {group} hash tag.
+	for _, key := range []string{groupRedisKey("@ops", "MEMBERS"), groupRedisKey("@ops", "EPOCH"), groupMemberKey("@ops", 7, "bob")} {
+		if !strings.HasPrefix(key, "RPIPE:GROUPS:{@ops}:") {
+			t.Errorf("key %q lacks the group hash tag", key)
+		}
+	}
+}
+
+// --- Queues ---
+
+func TestQueueKey_SameSlot(t *testing.T) {
+	for _, key := range []string{QueueKey("worker", "INSTANCES"), QueueKey("worker", "PRIV", "worker#1"), QueueKey("worker", "STREAM")} {
+		if !strings.HasPrefix(key, "RPIPE:QUEUES:{worker}:") {
+			t.Errorf("key %q lacks the service hash tag", key)
+		}
+	}
+}
+
+func TestPrivateKeyFor_Service(t *testing.T) {
+	own, _ := rsa.GenerateKey(rand.Reader, 1024)
+	service, _ := rsa.GenerateKey(rand.Reader, 1024)
+	c := &Cryptor{PrivateKey: own, services: map[string]*rsa.PrivateKey{"worker": service}}
+	if c.privateKeyFor("worker") != service {
+		t.Error("want the service key for a served queue")
+	}
+	if c.privateKeyFor("worker#1") != own {
+		t.Error("want the own key for the instance name")
+	}
+}
+
+func TestPubkeyFingerprint(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	fp := PubkeyFingerprint(&key.PublicKey)
+	if !strings.HasPrefix(fp, "SHA256:") || len(fp) != len("SHA256:")+43 {
+		t.Fatalf("unexpected fingerprint %q", fp)
+	}
+	if fp != PubkeyFingerprint(DecodePubkey(EncodePubkey(&key.PublicKey))) {
+		t.Error("fingerprint changed after an encode/decode round trip")
+	}
+}
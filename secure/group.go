@@ -0,0 +1,235 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var NotMemberError = errors.New("not a member of the group")
+
+// groupKeyGrace is how long the keys of a replaced epoch stay readable,
+// so messages sealed just before a re-key can still be opened.
+const groupKeyGrace = 10 * time.Minute
+
+const groupTxRetries = 10
+
+// Group keys live under one hash tag per group, so the membership
+// transaction stays within a single Redis Cluster slot:
+//
+//	RPIPE:GROUPS:{@ops}:MEMBERS          set of member names
+//	RPIPE:GROUPS:{@ops}:EPOCH            current key epoch
+//	RPIPE:GROUPS:{@ops}:KEY:<epoch>:<m>  the epoch's key, under m's pubkey
+func groupRedisKey(group string, parts ...string) string {
+	key := "RPIPE:GROUPS:{" + group + "}"
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+func groupMemberKey(group string, epoch int64, member string) string {
+	return groupRedisKey(group, "KEY", strconv.FormatInt(epoch, 10), member)
+}
+
+// GroupMembers returns the sorted members of group.
+func GroupMembers(ctx context.Context, rdb redis.UniversalClient, group string) ([]string, error) {
+	members, err := rdb.SMembers(ctx, groupRedisKey(group, "MEMBERS")).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// JoinGroup adds member to group and re-keys it. Joining again, e.g.
+// with a new pubkey after a restart, re-keys as well. Nodes sharing a
+// cryptor may join the same group as different members.
+func (c *Cryptor) JoinGroup(ctx context.Context, group, member string) error {
+	err := c.rekeyGroup(ctx, group, member, true)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.groups[group] == nil {
+		c.groups[group] = make(map[string]bool)
+	}
+	c.groups[group][member] = true
+	return nil
+}
+
+// LeaveGroup removes member from group and re-keys it for the others.
+func (c *Cryptor) LeaveGroup(ctx context.Context, group, member string) error {
+	c.mu.Lock()
+	delete(c.groups[group], member)
+	if len(c.groups[group]) == 0 {
+		delete(c.groups, group)
+	}
+	c.mu.Unlock()
+	return c.rekeyGroup(ctx, group, member, false)
+}
+
+// rekeyGroup applies a membership change and distributes a fresh key for
+// the next epoch to every member, under WATCH so concurrent changes are
+// retried rather than lost. Members without a registered pubkey are
+// skipped; they get a key when they join again.
+func (c *Cryptor) rekeyGroup(ctx context.Context, group, member string, join bool) error {
+	membersKey := groupRedisKey(group, "MEMBERS")
+	epochKey := groupRedisKey(group, "EPOCH")
+	txf := func(tx *redis.Tx) error {
+		oldMembers, err := tx.SMembers(ctx, membersKey).Result()
+		if err != nil {
+			return err
+		}
+		epoch, err := tx.Get(ctx, epochKey).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		members := make(map[string]bool)
+		for _, m := range oldMembers {
+			members[m] = true
+		}
+		members[member] = join
+		newEpoch := epoch + 1
+		newKey := randStringBytes(32)
+		wrapped := make(map[string]string)
+		for m, ok := range members {
+			if !ok {
+				continue
+			}
+			pubkey, err := c.fetchNodePubkey(ctx, m)
+			if errors.Is(err, NoPubkeyError) {
+				log.Debugf("Skipping group key for %s: %v", m, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			wrapped[m], err = EncryptPKI(pubkey, newKey)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if join {
+				pipe.SAdd(ctx, membersKey, member)
+			} else {
+				pipe.SRem(ctx, membersKey, member)
+			}
+			pipe.Set(ctx, epochKey, newEpoch, 0)
+			for m, w := range wrapped {
+				pipe.Set(ctx, groupMemberKey(group, newEpoch, m), w, 0)
+			}
+			for _, m := range oldMembers {
+				pipe.Expire(ctx, groupMemberKey(group, epoch, m), groupKeyGrace)
+			}
+			return nil
+		})
+		if err == nil && join {
+			c.store(groupCacheName(group, newEpoch), &SymKey{Key: newKey})
+		}
+		return err
+	}
+	for i := 0; i < groupTxRetries; i++ {
+		err := c.rdb.Watch(ctx, txf, membersKey, epochKey)
+		if err != redis.TxFailedErr {
+			if err == nil {
+				log.Debugf("Re-keyed %s after membership change of %s", group, member)
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("re-key %s: too many concurrent membership changes", group)
+}
+
+func groupCacheName(group string, epoch int64) string {
+	return group + "#" + strconv.FormatInt(epoch, 10)
+}
+
+// groupMember returns a name this cryptor joined group as. Its members
+// share the private key, so the copy of any of them will do.
+func (c *Cryptor) groupMember(group string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make([]string, 0, len(c.groups[group]))
+	for member := range c.groups[group] {
+		members = append(members, member)
+	}
+	if len(members) == 0 {
+		return "", fmt.Errorf("%w '%s'", NotMemberError, group)
+	}
+	sort.Strings(members)
+	return members[0], nil
+}
+
+// fetchGroupKey returns the key of group for epoch, unwrapped from the
+// copy stored for this cryptor's member.
+func (c *Cryptor) fetchGroupKey(ctx context.Context, group string, epoch int64) (*SymKey, error) {
+	if symKey, ok := c.cached(groupCacheName(group, epoch)); ok {
+		return symKey, nil
+	}
+	member, err := c.groupMember(group)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := c.rdb.Get(ctx, groupMemberKey(group, epoch, member)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("no key for %s epoch %d: %w", group, epoch, ExpireError)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecryptPKI(c.PrivateKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	symKey := &SymKey{Key: key}
+	c.store(groupCacheName(group, epoch), symKey)
+	return symKey, nil
+}
+
+// sealGroup encrypts msg.Data with the current key of the group msg.To.
+func (c *Cryptor) sealGroup(ctx context.Context, msg *msgspec.RpipeMsg) error {
+	if _, err := c.groupMember(msg.To); err != nil {
+		return err
+	}
+	epoch, err := c.rdb.Get(ctx, groupRedisKey(msg.To, "EPOCH")).Int64()
+	if err != nil {
+		return fmt.Errorf("group epoch: %w", err)
+	}
+	symKey, err := c.fetchGroupKey(ctx, msg.To, epoch)
+	if err != nil {
+		return err
+	}
+	cryptedData, err := EncryptMessage(symKey, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Data = cryptedData
+	msg.Secured = true
+	msg.Epoch = epoch
+	return nil
+}
+
+// openGroup decrypts msg.Data with the key of the epoch it was sealed in.
+func (c *Cryptor) openGroup(ctx context.Context, msg *msgspec.RpipeMsg) error {
+	symKey, err := c.fetchGroupKey(ctx, msg.To, msg.Epoch)
+	if err != nil {
+		return fmt.Errorf("fetch group key: %w", err)
+	}
+	decryptedData, err := DecryptMessage(symKey, msg.Data)
+	if err != nil {
+		decryptFailures.WithLabelValues(msg.From).Inc()
+		return err
+	}
+	msg.Data = decryptedData
+	msg.Secured = false
+	return nil
+}
@@ -0,0 +1,29 @@
+package secure
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	decryptFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "decrypt_failures_total",
+		Help:      "Messages that could not be decrypted, by sender.",
+	}, []string{"peer"})
+	decryptRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "decrypt_retries_total",
+		Help:      "Decryptions retried with a symkey fetched again from Redis.",
+	})
+	symkeyRotations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "symkey_rotations_total",
+		Help:      "Outbound symkeys rotated because they expired or were missing.",
+	})
+	symkeyResets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "rpipe",
+		Name:      "symkey_resets_total",
+		Help:      "Inbound symkey resets requested by peers.",
+	})
+)
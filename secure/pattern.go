@@ -0,0 +1,172 @@
+package secure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pattern receivers register their pubkey per pattern, so senders to any
+// matching channel can find it:
+//
+//	RPIPE:PATTERNS             set of registered patterns
+//	RPIPE:PATTERNS:<pattern>   pubkey of the receiver subscribed to it
+//	RPIPE:PATTERN-OWNERS       hash of pattern to the name of that receiver
+const (
+	patternsKey      = "RPIPE:PATTERNS"
+	patternOwnersKey = "RPIPE:PATTERN-OWNERS"
+	// presenceKey is the hash of node presence records kept by package
+	// rpipe, whose 'expires' tells whether a node is running.
+	presenceKey = "RPIPE:PRESENCE"
+)
+
+// RegisterPattern publishes this cryptor's pubkey for channels matching
+// pattern, on behalf of the node owner. Symkeys to matching channels were
+// sealed for a previous receiver, so they are dropped and their senders
+// asked to renegotiate.
+func (c *Cryptor) RegisterPattern(ctx context.Context, pattern, owner string) error {
+	pubkeyStr := EncodePubkey(&c.PrivateKey.PublicKey)
+	err := c.rdb.Set(ctx, patternsKey+":"+pattern, pubkeyStr, 0).Err()
+	if err != nil {
+		return err
+	}
+	err = c.rdb.HSet(ctx, patternOwnersKey, pattern, owner).Err()
+	if err != nil {
+		return err
+	}
+	err = c.rdb.SAdd(ctx, patternsKey, pattern).Err()
+	if err != nil {
+		return err
+	}
+
+	keys, err := c.keys(ctx, "RPIPE:SYMKEYS:*:"+pattern)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		ks := strings.SplitN(k, ":", 4)
+		sender, channel := ks[2], ks[3]
+		if !msgspec.MatchPattern(pattern, channel) {
+			continue
+		}
+		_, err := c.rdb.Del(ctx, k).Result()
+		if err != nil {
+			return err
+		}
+		// The reset comes from the channel the sender writes to, so it
+		// re-keys that direction.
+		resetMsg := msgspec.RpipeMsg{From: channel, To: sender, Control: msgspec.ControlResetSymkey}
+		msgLog(&resetMsg, msgspec.DirectionOut).Debugf("[PUB-%s] %s", sender, resetMsg.Marshal())
+		err = c.rdb.Publish(ctx, sender, resetMsg.Marshal()).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnregisterPattern removes the registration of pattern, unless another
+// receiver has registered it since.
+func (c *Cryptor) UnregisterPattern(ctx context.Context, pattern string) error {
+	pubkeyStr := EncodePubkey(&c.PrivateKey.PublicKey)
+	key := patternsKey + ":" + pattern
+	txf := func(tx *redis.Tx) error {
+		registered, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if registered != pubkeyStr {
+			// registered again by another receiver
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.HDel(ctx, patternOwnersKey, pattern)
+			pipe.SRem(ctx, patternsKey, pattern)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < groupTxRetries; i++ {
+		err := c.rdb.Watch(ctx, txf, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("unregister pattern '%s': too many concurrent registrations", pattern)
+}
+
+// MatchingPatterns returns the registered patterns that match channel and
+// whose receiver is running, in sorted order. A pattern registered by an
+// older node, without an owner, is assumed to be running.
+func (c *Cryptor) MatchingPatterns(ctx context.Context, channel string) ([]string, error) {
+	patterns, err := c.rdb.SMembers(ctx, patternsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(patterns)
+	var live []string
+	for _, pattern := range patterns {
+		if !msgspec.MatchPattern(pattern, channel) {
+			continue
+		}
+		owner, err := c.rdb.HGet(ctx, patternOwnersKey, pattern).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if owner != "" {
+			record, err := c.rdb.HGet(ctx, presenceKey, owner).Result()
+			if err != nil && err != redis.Nil {
+				return nil, err
+			}
+			if !presenceLive(record, time.Now()) {
+				log.Debugf("Ignoring pattern '%s' of %s, which is not running", pattern, owner)
+				continue
+			}
+		}
+		live = append(live, pattern)
+	}
+	return live, nil
+}
+
+// presenceLive tells whether a presence record, empty if there is none,
+// has not expired at now.
+func presenceLive(record string, now time.Time) bool {
+	var p struct {
+		Expires time.Time `json:"expires"`
+	}
+	if record == "" || json.Unmarshal([]byte(record), &p) != nil {
+		return false
+	}
+	return now.Before(p.Expires)
+}
+
+// fetchPatternPubkey returns the pubkey registered for the first pattern,
+// in sorted order, that matches channel and whose receiver is running.
+func (c *Cryptor) fetchPatternPubkey(ctx context.Context, channel string) (string, error) {
+	patterns, err := c.MatchingPatterns(ctx, channel)
+	if err != nil {
+		return "", err
+	}
+	for _, pattern := range patterns {
+		pubkey, err := c.rdb.Get(ctx, patternsKey+":"+pattern).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		log.Debugf("Using pubkey of pattern '%s' for '%s'", pattern, channel)
+		return pubkey, nil
+	}
+	return "", fmt.Errorf("%w for '%s': is it running?", NoPubkeyError, channel)
+}
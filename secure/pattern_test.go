@@ -0,0 +1,25 @@
+package secure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceLive(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{`{"name":"collector","expires":"2026-01-02T03:04:35Z"}`, true},
+		{`{"name":"collector","expires":"2026-01-02T03:04:00Z"}`, false},
+		{`{"name":"collector"}`, false},
+		{"", false},
+		{"not json", false},
+	}
+	for _, tt := range tests {
+		if got := presenceLive(tt.record, now); got != tt.want {
+			t.Errorf("presenceLive(%q) = %t, want %t", tt.record, got, tt.want)
+		}
+	}
+}
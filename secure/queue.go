@@ -0,0 +1,277 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"strings"
+	"time"
+)
+
+var NoQueueKeyError = errors.New("no live instance handed over the queue key")
+
+// A queue service is served by several instances that share one service
+// keypair, registered as the service's pubkey, so senders seal for the
+// service as for any node. Keys of a service share its hash tag:
+//
+//	RPIPE:QUEUES:{svc}:INSTANCES     set of instance names
+//	RPIPE:QUEUES:{svc}:ALIVE:<i>     heartbeat of instance i, with a TTL
+//	RPIPE:QUEUES:{svc}:PRIV:<i>      service private key, sealed for i
+//	RPIPE:QUEUES:{svc}:KEYGEN        lock held while a keypair is created
+//	RPIPE:QUEUES:{svc}:STREAM        the messages, read by a consumer group
+func QueueKey(service string, parts ...string) string {
+	key := "RPIPE:QUEUES:{" + service + "}"
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+const (
+	// QueueAliveTTL is how long an instance counts as alive after its
+	// last heartbeat.
+	QueueAliveTTL = 15 * time.Second
+
+	queueKeygenTTL  = 10 * time.Second
+	queueJoinWait   = QueueAliveTTL + 5*time.Second
+	queueJoinPoll   = 200 * time.Millisecond
+	queuePrivPrefix = "PRIV"
+)
+
+// JoinQueue makes instance an instance of service. The first live
+// instance creates the service keypair; later ones wait for a live
+// instance to hand it over, see MaintainQueue.
+func (c *Cryptor) JoinQueue(ctx context.Context, service, instance string) error {
+	err := c.rdb.SAdd(ctx, QueueKey(service, "INSTANCES"), instance).Err()
+	if err != nil {
+		return err
+	}
+	err = c.heartbeat(ctx, service, instance)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(queueJoinWait)
+	for {
+		key, err := c.fetchQueueKey(ctx, service, instance)
+		if err == nil {
+			c.mu.Lock()
+			c.services[service] = key
+			c.mu.Unlock()
+			return nil
+		}
+		if err != redis.Nil {
+			return err
+		}
+		live, err := c.liveInstances(ctx, service, instance)
+		if err != nil {
+			return err
+		}
+		if len(live) == 0 {
+			created, err := c.createQueueKey(ctx, service, instance)
+			if err != nil || created {
+				return err
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w for '%s'", NoQueueKeyError, service)
+		}
+		select {
+		case <-time.After(queueJoinPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// createQueueKey creates and registers a new service keypair unless
+// another instance is already doing so. Symkeys sealed for a previous
+// keypair are dropped and their senders asked to renegotiate.
+func (c *Cryptor) createQueueKey(ctx context.Context, service, instance string) (bool, error) {
+	locked, err := c.rdb.SetNX(ctx, QueueKey(service, "KEYGEN"), instance, queueKeygenTTL).Result()
+	if err != nil || !locked {
+		return false, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return false, err
+	}
+	err = c.storeQueueKey(ctx, service, instance, key, &key.PublicKey)
+	if err != nil {
+		return false, err
+	}
+	err = c.rdb.Set(ctx, "RPIPE:PUBKEYS:"+service, EncodePubkey(&key.PublicKey), 0).Err()
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.services[service] = key
+	c.mu.Unlock()
+	log.Debugf("Created keypair for queue %s", service)
+
+	keys, err := c.keys(ctx, "RPIPE:SYMKEYS:*:"+service)
+	if err != nil {
+		return true, err
+	}
+	for _, k := range keys {
+		sender := strings.SplitN(k, ":", 4)[2]
+		_ = c.rdb.Del(ctx, k).Err()
+		resetMsg := msgspec.RpipeMsg{From: service, To: sender, Control: msgspec.ControlResetSymkey}
+		err = c.rdb.Publish(ctx, sender, resetMsg.Marshal()).Err()
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, c.rdb.Del(ctx, QueueKey(service, "KEYGEN")).Err()
+}
+
+// MaintainQueue refreshes the heartbeat of instance, hands the service key
+// over to live instances that lack it and forgets dead ones. Each instance
+// runs it periodically, well within QueueAliveTTL.
+//
+// Any name in the INSTANCES set with a heartbeat and a pubkey is handed the
+// key, so anyone with write access to Redis can enrol: as for groups, Redis
+// access control is the trust boundary.
+func (c *Cryptor) MaintainQueue(ctx context.Context, service, instance string) error {
+	err := c.heartbeat(ctx, service, instance)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	key := c.services[service]
+	c.mu.Unlock()
+	if key == nil {
+		return fmt.Errorf("%w for '%s'", NoQueueKeyError, service)
+	}
+	members, err := c.rdb.SMembers(ctx, QueueKey(service, "INSTANCES")).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		alive, err := c.rdb.Exists(ctx, QueueKey(service, "ALIVE", member)).Result()
+		if err != nil {
+			return err
+		}
+		if alive == 0 {
+			log.Debugf("Removing dead instance %s of %s", member, service)
+			_ = c.rdb.SRem(ctx, QueueKey(service, "INSTANCES"), member).Err()
+			_ = c.rdb.Del(ctx, QueueKey(service, queuePrivPrefix, member)).Err()
+			continue
+		}
+		has, err := c.rdb.Exists(ctx, QueueKey(service, queuePrivPrefix, member)).Result()
+		if err != nil || has > 0 {
+			continue
+		}
+		pubkey, err := c.fetchNodePubkey(ctx, member)
+		if err != nil {
+			log.Debugf("Cannot hand over %s key to %s: %v", service, member, err)
+			continue
+		}
+		err = c.storeQueueKey(ctx, service, member, key, pubkey)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Handed over %s key to %s", service, member)
+	}
+	return nil
+}
+
+// LeaveQueue removes instance from service. The service keypair stays
+// with the remaining instances.
+func (c *Cryptor) LeaveQueue(ctx context.Context, service, instance string) error {
+	c.mu.Lock()
+	delete(c.services, service)
+	c.mu.Unlock()
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, QueueKey(service, "INSTANCES"), instance)
+		pipe.Del(ctx, QueueKey(service, "ALIVE", instance), QueueKey(service, queuePrivPrefix, instance))
+		return nil
+	})
+	return err
+}
+
+func (c *Cryptor) heartbeat(ctx context.Context, service, instance string) error {
+	return c.rdb.Set(ctx, QueueKey(service, "ALIVE", instance), time.Now().Unix(), QueueAliveTTL).Err()
+}
+
+// liveInstances returns the instances of service other than self with a
+// current heartbeat and the service key.
+func (c *Cryptor) liveInstances(ctx context.Context, service, self string) ([]string, error) {
+	members, err := c.rdb.SMembers(ctx, QueueKey(service, "INSTANCES")).Result()
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, member := range members {
+		if member == self {
+			continue
+		}
+		n, err := c.rdb.Exists(ctx, QueueKey(service, "ALIVE", member), QueueKey(service, queuePrivPrefix, member)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if n == 2 {
+			live = append(live, member)
+		}
+	}
+	return live, nil
+}
+
+// storeQueueKey seals the service private key for member: a fresh AES key
+// encrypts the key, and member's pubkey encrypts the AES key.
+func (c *Cryptor) storeQueueKey(ctx context.Context, service, member string, key *rsa.PrivateKey, pubkey *rsa.PublicKey) error {
+	aesKey := randStringBytes(32)
+	sealedKey, err := EncryptMessage(&SymKey{Key: aesKey}, x509.MarshalPKCS1PrivateKey(key))
+	if err != nil {
+		return err
+	}
+	wrappedAES, err := EncryptPKI(pubkey, aesKey)
+	if err != nil {
+		return err
+	}
+	value := wrappedAES + "." + base64.StdEncoding.EncodeToString(sealedKey)
+	return c.rdb.Set(ctx, QueueKey(service, queuePrivPrefix, member), value, 0).Err()
+}
+
+// fetchQueueKey opens the service private key sealed for instance. It
+// returns redis.Nil until one has been handed over.
+func (c *Cryptor) fetchQueueKey(ctx context.Context, service, instance string) (*rsa.PrivateKey, error) {
+	value, err := c.rdb.Get(ctx, QueueKey(service, queuePrivPrefix, instance)).Result()
+	if err != nil {
+		return nil, err
+	}
+	wrappedAES, sealedB64, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid queue key for '%s'", instance)
+	}
+	aesKey, err := DecryptPKI(c.PrivateKey, wrappedAES)
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(sealedB64)
+	if err != nil {
+		return nil, err
+	}
+	der, err := DecryptMessage(&SymKey{Key: aesKey}, sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// privateKeyFor returns the key that opens symkeys sealed for channel:
+// the service key for a queue this cryptor serves, else its own.
+func (c *Cryptor) privateKeyFor(channel string) *rsa.PrivateKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.services[channel]; ok {
+		return key
+	}
+	return c.PrivateKey
+}
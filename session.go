@@ -0,0 +1,608 @@
+package rpipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sng2c/rpipe/msgspec"
+	"github.com/sng2c/rpipe/pipe"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrTargetFixed = errors.New("the target of a pipe mode session cannot change")
+var ErrQueueTarget = errors.New("pipe mode cannot target a queue: its instances would each get part of the stream")
+
+// Chat formats, see SessionOptions.ChatFormat.
+const (
+	ChatFormatText = "text"
+	ChatFormatJSON = "json"
+)
+
+type SessionOptions struct {
+	// Target is the default peer. It is required in pipe mode.
+	Target string
+	// Chat selects chat mode: local lines are 'TARGET<message' and
+	// remote lines are written as 'SENDER>message'.
+	Chat bool
+	// ChatFormat is ChatFormatText, the default, or ChatFormatJSON: one
+	// msgspec.ChatMsg per line each way, so that a message may hold
+	// newlines or binary data. The JSON format also carries streams, RPC
+	// calls and their replies, broadcasts and stream closes.
+	ChatFormat string
+
+	// In carries local data to send; Session.Run returns when it closes.
+	In <-chan []byte
+	// Err carries local diagnostics, copied to os.Stderr.
+	Err <-chan []byte
+	// Out receives data from remote peers.
+	Out chan<- []byte
+	// StopInput is called by Drain to make In close once what was already
+	// read has come through, e.g. by cancelling the reader of In or asking
+	// a command to finish. Without it, Drain abandons In at once.
+	StopInput func()
+
+	// Window is the number of unacknowledged pipe mode bytes after which
+	// local input is paused. Zero disables flow control.
+	Window int
+
+	// ConnectTimeout enables the pipe mode handshake: local data is held
+	// back until the target answers a hello, which also negotiates the
+	// symkeys. Run fails with ErrConnectTimeout if data has waited this
+	// long. Zero sends right away.
+	ConnectTimeout time.Duration
+}
+
+// Session relays between a Node and local byte channels, in pipe or chat mode.
+// In chat mode, lines from a group are written as 'GROUP/SENDER>message',
+// and other nodes joining or leaving are logged.
+type Session struct {
+	node *Node
+	opts SessionOptions
+
+	channelLineBufferMap map[string][]byte
+	sendWindow           *sendWindow
+	recvWindows          map[string]*recvWindow
+	// chatParts holds JSON chat messages until their last block arrives.
+	chatParts map[string]*msgspec.RpipeMsg
+	// calls maps the correlation ids of unanswered calls to their callers.
+	calls map[string]string
+
+	targetMu  sync.Mutex
+	target    string
+	drainCh   chan struct{}
+	drainOnce sync.Once
+}
+
+func NewSession(node *Node, opts SessionOptions) *Session {
+	if msgspec.IsGroup(opts.Target) {
+		// Acks from many members do not add up to one window.
+		opts.Window = 0
+	}
+	return &Session{
+		node:                 node,
+		opts:                 opts,
+		channelLineBufferMap: make(map[string][]byte),
+		chatParts:            make(map[string]*msgspec.RpipeMsg),
+		calls:                make(map[string]string),
+		sendWindow:           newSendWindow(opts.Window),
+		recvWindows:          make(map[string]*recvWindow),
+		target:               opts.Target,
+		drainCh:              make(chan struct{}),
+	}
+}
+
+// Target returns the default peer.
+func (s *Session) Target() string {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	return s.target
+}
+
+// SetTarget changes the default peer of a chat mode session.
+func (s *Session) SetTarget(target string) error {
+	if !s.opts.Chat {
+		return ErrTargetFixed
+	}
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	s.target = target
+	return nil
+}
+
+// Drain makes Run stop local input, see SessionOptions.StopInput, and
+// return once it has closed: data already read is still sent, messages
+// already received are written out and, in pipe mode, the target gets its
+// EOF.
+func (s *Session) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.drainCh)
+	})
+}
+
+// Run relays until local input closes, ctx is cancelled or, in pipe mode,
+// the target sends EOF or a send fails. In pipe mode an EOF is sent to the
+// target on return. A queue target is refused in pipe mode.
+func (s *Session) Run(ctx context.Context) error {
+	pipeMode := !s.opts.Chat
+	if pipeMode {
+		if queued, _ := s.node.IsQueue(s.Target()); queued {
+			return fmt.Errorf("%w: '%s'", ErrQueueTarget, s.Target())
+		}
+	}
+	fromLocalCh := s.opts.In
+	fromLocalErrorCh := s.opts.Err
+	drainCh := s.drainCh
+	remoteCh := s.node.Receive()
+	var presenceCh <-chan PresenceEvent
+	if s.opts.Chat {
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		presenceCh = s.node.WatchPresence(watchCtx)
+	}
+	var runErr error
+	var remoteEOF bool
+
+	var hs *handshake
+	var held []byte
+	var inputClosed bool
+	if pipeMode && s.opts.ConnectTimeout > 0 {
+		hs = newHandshake(s.opts.ConnectTimeout)
+		defer hs.stop()
+		s.sendHello(hs.nonce)
+	}
+
+MainLoop:
+	for {
+		localCh := fromLocalCh
+		if pipeMode && s.sendWindow.exhausted() {
+			log.Debugln("Send window exhausted, pausing local input")
+			localCh = nil
+		}
+		if hs.waiting() && (held != nil || inputClosed) {
+			localCh = nil
+		}
+		select {
+		case data, ok := <-fromLocalErrorCh: // CHILD -> STDERR
+			log.Debugln("case <-fromLocalErrorCh")
+			if ok == false {
+				// the command may have more output; In closes after it
+				log.Debugf("fromLocalErrorCh is closed\n")
+				fromLocalErrorCh = nil
+				continue MainLoop
+			}
+			_, _ = os.Stderr.Write(data)
+
+		case data, ok := <-localCh: // CHILD -> REDIS
+			log.Debugln("case <-fromLocalCh")
+			if ok == false {
+				log.Debugf("fromLocalCh is closed\n")
+				if hs.waiting() {
+					inputClosed = true
+					hs.arm()
+					continue MainLoop
+				}
+				break MainLoop
+			}
+			if hs.waiting() {
+				held = data
+				hs.arm()
+				continue MainLoop
+			}
+			runErr = s.sendLocal(data)
+			if runErr != nil {
+				break MainLoop
+			}
+
+		case <-ctx.Done():
+			log.Debugln("case <-ctx.Done()")
+			break MainLoop
+
+		case <-drainCh:
+			log.Debugln("Draining")
+			drainCh = nil
+			if s.opts.StopInput != nil {
+				s.opts.StopInput()
+				continue MainLoop
+			}
+			fromLocalCh = nil
+			if hs.waiting() {
+				inputClosed = true
+				hs.arm()
+				continue MainLoop
+			}
+			break MainLoop
+
+		case <-hs.helloC():
+			s.sendHello(hs.nonce)
+
+		case <-hs.timeoutC():
+			runErr = fmt.Errorf("%w: %s did not answer within %s", ErrConnectTimeout, s.Target(), s.opts.ConnectTimeout)
+			break MainLoop
+
+		case event, ok := <-presenceCh:
+			if !ok {
+				presenceCh = nil
+				continue MainLoop
+			}
+			s.notifyPresence(event)
+
+		case msg, ok := <-remoteCh:
+			log.Debugln("case <-remoteCh")
+			if ok == false {
+				log.Debugf("remoteCh is closed\n")
+				break MainLoop
+			}
+			if s.jsonChat() && s.receiveChatControl(msg) {
+				continue MainLoop
+			}
+			if msg.Stream != 0 && !s.jsonChat() {
+				s.node.msgLog(msg, msgspec.DirectionIn).Debugf("Ignoring stream %d message from %s", msg.Stream, msg.From)
+				continue MainLoop
+			}
+			if !s.fromTarget(msg) {
+				continue MainLoop
+			}
+			if msg.Control == msgspec.ControlEOF {
+				if pipeMode {
+					s.node.msgLog(msg, msgspec.DirectionIn).Debugln("EOF received in pipe mode")
+					remoteEOF = true
+					break MainLoop
+				}
+				continue MainLoop
+			}
+			if msg.Control == msgspec.ControlAck {
+				s.sendWindow.onAck(msg.Ack)
+				continue MainLoop
+			}
+			if hs.answeredBy(msg) {
+				s.node.msgLog(msg, msgspec.DirectionIn).Debugf("%s is ready", msg.From)
+				if held != nil {
+					runErr = s.sendLocal(held)
+					held = nil
+					if runErr != nil {
+						break MainLoop
+					}
+				}
+				if inputClosed {
+					break MainLoop
+				}
+				continue MainLoop
+			}
+			if msg.Control != msgspec.ControlData {
+				continue MainLoop
+			}
+			s.receiveRemote(msg)
+		}
+	}
+	if ctx.Err() == nil && !remoteEOF {
+		s.deliverPending(remoteCh)
+	}
+	if pipeMode {
+		err := s.node.SendEOF(s.Target())
+		if err != nil {
+			log.Debugln("Failed to send EOF", err)
+		}
+	}
+	s.flushLines()
+	for cid, caller := range s.calls {
+		s.node.logger().WithField("peer", caller).Warningf("Call %s from %s left unanswered", cid, caller)
+	}
+	return runErr
+}
+
+// fromTarget reports whether msg may be written out: in pipe mode only
+// the target is heard.
+func (s *Session) fromTarget(msg *msgspec.RpipeMsg) bool {
+	if !s.opts.Chat {
+		target := s.Target()
+		if msg.From != target && msg.To != target {
+			s.node.msgLog(msg, msgspec.DirectionIn).Warningf("Ignoring message from %s: not from target", msg.From)
+			droppedMessages.WithLabelValues("not_from_target").Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// deliverPending writes out the data messages already received when Run
+// stops, instead of leaving them to Node.Close.
+func (s *Session) deliverPending(remoteCh <-chan *msgspec.RpipeMsg) {
+	for {
+		select {
+		case msg, ok := <-remoteCh:
+			if !ok {
+				return
+			}
+			if msg.Control == msgspec.ControlData && (msg.Stream == 0 || s.jsonChat()) && s.fromTarget(msg) {
+				s.receiveRemote(msg)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flushLines writes out the incomplete last line or JSON chat message of
+// each chat sender, as no more of it will arrive.
+func (s *Session) flushLines() {
+	senders := make([]string, 0, len(s.channelLineBufferMap))
+	for sender := range s.channelLineBufferMap {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	for _, sender := range senders {
+		appMsg := &msgspec.ApplicationMsg{Name: sender, Data: s.channelLineBufferMap[sender]}
+		s.opts.Out <- append(appMsg.Encode(), '\n')
+		delete(s.channelLineBufferMap, sender)
+	}
+	keys := make([]string, 0, len(s.chatParts))
+	for key := range s.chatParts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.writeChatMsg(s.chatParts[key])
+		delete(s.chatParts, key)
+	}
+}
+
+// sendHello asks the target to confirm it is listening.
+func (s *Session) sendHello(nonce string) {
+	err := s.node.Publish(&msgspec.RpipeMsg{To: s.Target(), Control: msgspec.ControlHello, Data: []byte(nonce)})
+	if err != nil {
+		log.Debugf("Hello to %s failed: %v", s.Target(), err)
+	}
+}
+
+// notifyPresence logs a join or leave, except of short lived nodes such
+// as those of 'rpipe call'.
+func (s *Session) notifyPresence(event PresenceEvent) {
+	if event.Peer.Ephemeral {
+		return
+	}
+	switch event.Event {
+	case PresenceJoin:
+		s.node.logger().WithField("peer", event.Peer.Name).Infof("%s joined from %s", event.Peer.Name, event.Peer.Host)
+	case PresenceLeave:
+		s.node.logger().WithField("peer", event.Peer.Name).Infof("%s left", event.Peer.Name)
+	}
+}
+
+// jsonChat reports whether the session is in chat mode with the JSON chat
+// format.
+func (s *Session) jsonChat() bool {
+	return s.opts.Chat && s.opts.ChatFormat == ChatFormatJSON
+}
+
+// sendLocal sends local data to its target. Failures are logged in chat
+// mode; in pipe mode, where a lost block corrupts the stream, they end
+// the session.
+func (s *Session) sendLocal(data []byte) error {
+	if s.jsonChat() {
+		s.sendChatMsg(data)
+		return nil
+	}
+	to := s.Target()
+	if s.opts.Chat {
+		log.Debugln(string(data))
+		appMsg, err := msgspec.NewApplicationMsg(data)
+		if err != nil {
+			log.Warningln("Failed to parse message: expected TARGET<message format", err)
+			return nil
+		}
+		if appMsg.Name != "" {
+			to = appMsg.Name
+		}
+		data = appMsg.Data
+	}
+	if to == "" {
+		log.Warningln("No target in message: name one in the message or specify -target flag")
+		return nil
+	}
+	err := s.node.Send(to, data)
+	if err != nil {
+		if !s.opts.Chat {
+			return fmt.Errorf("send to %s: %w", to, err)
+		}
+		s.node.logger().WithField("peer", to).Warningln("Failed to send message to "+to, err)
+		return nil
+	}
+	s.sendWindow.onSent(len(data))
+	return nil
+}
+
+func (s *Session) receiveRemote(msg *msgspec.RpipeMsg) {
+	if !s.opts.Chat {
+		// pipemode : feed as-is
+		s.opts.Out <- msg.Data
+		s.ack(msg)
+		return
+	}
+	if s.opts.ChatFormat == ChatFormatJSON {
+		s.receiveChatMsg(msg)
+		s.ack(msg)
+		return
+	}
+	// non-pipemode : feed by line group by sessionId
+	sender := msg.From
+	if msgspec.IsGroup(msg.To) {
+		sender = msg.To + "/" + msg.From
+	}
+	lineBuf, ok := s.channelLineBufferMap[sender]
+	if !ok {
+		lineBuf = []byte{}
+	}
+	lineBuf = append(lineBuf, msg.Data...)
+	lines, lineBuf, err := pipe.FeedLines(lineBuf, false)
+	if err != nil {
+		log.Warningln("Session reset", err)
+		delete(s.channelLineBufferMap, sender)
+		return
+	}
+	if len(lineBuf) == 0 {
+		delete(s.channelLineBufferMap, sender)
+	} else {
+		s.channelLineBufferMap[sender] = lineBuf
+	}
+	// feed all
+	for _, line := range lines {
+		appMsg := &msgspec.ApplicationMsg{
+			Name: sender,
+			Data: line,
+		}
+		s.opts.Out <- append(appMsg.Encode(), '\n')
+	}
+	s.ack(msg)
+}
+
+// sendChatMsg sends a line of the JSON chat format, or does what its type
+// asks. Failures are logged.
+func (s *Session) sendChatMsg(line []byte) {
+	log.Debugln(string(line))
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+	chatMsg, err := msgspec.ParseChatMsg(line)
+	var data []byte
+	if err == nil {
+		data, err = chatMsg.Payload()
+	}
+	if err != nil {
+		log.Warningln(`Failed to parse message: expected a JSON object such as {"to":"bob","data":"hi"}`, err)
+		return
+	}
+	to := chatMsg.To
+	if to == "" {
+		to = s.Target()
+	}
+	switch chatMsg.Type {
+	case "", msgspec.ChatMessage, msgspec.ChatClose:
+		if to == "" {
+			log.Warningln("No target in message: name one in the message or specify -target flag")
+			return
+		}
+		if chatMsg.Type != msgspec.ChatClose {
+			err = s.node.SendStream(to, chatMsg.Stream, data)
+		} else if chatMsg.Stream == 0 {
+			err = s.node.SendEOF(to)
+		} else {
+			err = s.node.Publish(&msgspec.RpipeMsg{To: to, Control: msgspec.ControlStreamClose, Stream: chatMsg.Stream})
+		}
+	case msgspec.ChatReply:
+		caller, ok := s.calls[chatMsg.Cid]
+		if !ok {
+			log.Warningf("Dropping reply to %s: no such call is pending", chatMsg.Cid)
+			return
+		}
+		delete(s.calls, chatMsg.Cid)
+		to = caller
+		err = s.node.Publish(&msgspec.RpipeMsg{To: caller, Control: msgspec.ControlReply, Cid: chatMsg.Cid, Data: data})
+	case msgspec.ChatBroadcast:
+		s.broadcast(chatMsg.Stream, data)
+		return
+	default:
+		log.Warningf("Dropping message of unknown type '%s'", chatMsg.Type)
+		return
+	}
+	if err != nil {
+		s.node.logger().WithField("peer", to).Warningln("Failed to send message to "+to, err)
+	}
+}
+
+// broadcast sends data to every other online node. Queue instances are
+// left out, as they are reached through their queue.
+func (s *Session) broadcast(stream uint32, data []byte) {
+	peers, err := s.node.Peers()
+	if err != nil {
+		log.Warningln("Failed to list peers for a broadcast", err)
+		return
+	}
+	for _, peer := range peers {
+		if peer.Name == s.node.Name || peer.Ephemeral {
+			continue
+		}
+		err = s.node.SendStream(peer.Name, stream, data)
+		if err != nil {
+			s.node.logger().WithField("peer", peer.Name).Warningln("Failed to broadcast to "+peer.Name, err)
+		}
+	}
+}
+
+// receiveChatControl writes out calls, EOFs and stream closes in the JSON
+// chat format, and reports whether msg was one of them.
+func (s *Session) receiveChatControl(msg *msgspec.RpipeMsg) bool {
+	var chatMsg *msgspec.ChatMsg
+	switch msg.Control {
+	case msgspec.ControlCall:
+		s.node.msgLog(msg, msgspec.DirectionIn).Debugf("Call %s from %s", msg.Cid, msg.From)
+		s.calls[msg.Cid] = msg.From
+		chatMsg = msgspec.NewChatMsg(msg.From, s.chatTo(msg), msg.Data)
+		chatMsg.Type = msgspec.ChatCall
+		chatMsg.Cid = msg.Cid
+	case msgspec.ControlEOF, msgspec.ControlStreamClose:
+		chatMsg = &msgspec.ChatMsg{Type: msgspec.ChatClose, From: msg.From, To: s.chatTo(msg), Stream: msg.Stream}
+	default:
+		return false
+	}
+	s.opts.Out <- append(chatMsg.Encode(), '\n')
+	return true
+}
+
+// chatTo returns the To of a received ChatMsg: left out unless it names a
+// group, pattern channel or queue rather than this node.
+func (s *Session) chatTo(msg *msgspec.RpipeMsg) string {
+	if msg.To == s.node.Name {
+		return ""
+	}
+	return msg.To
+}
+
+// receiveChatMsg writes msg out as a msgspec.ChatMsg, together with the
+// messages that continue it, see msgspec.RpipeMsg.More.
+func (s *Session) receiveChatMsg(msg *msgspec.RpipeMsg) {
+	key := fmt.Sprintf("%s %s %d", msg.From, msg.To, msg.Stream)
+	if part, ok := s.chatParts[key]; ok {
+		part.Data = append(part.Data, msg.Data...)
+		part.More = msg.More
+		msg = part
+	} else {
+		msg = &msgspec.RpipeMsg{From: msg.From, To: msg.To, Stream: msg.Stream, Data: msg.Data, More: msg.More}
+	}
+	if msg.More {
+		s.chatParts[key] = msg
+		return
+	}
+	delete(s.chatParts, key)
+	s.writeChatMsg(msg)
+}
+
+// writeChatMsg writes msg as a msgspec.ChatMsg.
+func (s *Session) writeChatMsg(msg *msgspec.RpipeMsg) {
+	chatMsg := msgspec.NewChatMsg(msg.From, s.chatTo(msg), msg.Data)
+	chatMsg.Stream = msg.Stream
+	s.opts.Out <- append(chatMsg.Encode(), '\n')
+}
+
+// ack acknowledges pipe mode data once it has been written out, so a
+// pipe mode sender keeps going, including into a chat mode collector.
+func (s *Session) ack(msg *msgspec.RpipeMsg) {
+	if !msg.Pipe || msgspec.IsGroup(msg.To) || s.node.servesQueue(msg.To) {
+		return
+	}
+	w, ok := s.recvWindows[msg.From]
+	if !ok {
+		w = &recvWindow{}
+		s.recvWindows[msg.From] = w
+	}
+	if ack, due := w.onConsumed(len(msg.Data)); due {
+		err := s.node.ackFor(msg, ack)
+		if err != nil {
+			s.node.msgLog(msg, msgspec.DirectionIn).Warningln("Failed to send ack", err)
+		}
+	}
+}
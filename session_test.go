@@ -0,0 +1,144 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"github.com/sng2c/rpipe/msgspec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSession_SetTarget(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1})
+	chat := NewSession(n, SessionOptions{Target: "bob", Chat: true})
+	if err := chat.SetTarget("carol"); err != nil || chat.Target() != "carol" {
+		t.Fatalf("want carol, got %s (%v)", chat.Target(), err)
+	}
+	pipe := NewSession(n, SessionOptions{Target: "bob"})
+	if err := pipe.SetTarget("carol"); !errors.Is(err, ErrTargetFixed) || pipe.Target() != "bob" {
+		t.Fatalf("want ErrTargetFixed, got %v", err)
+	}
+}
+
+func TestSession_Drain(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1})
+	s := NewSession(n, SessionOptions{Target: "bob", In: make(chan []byte), Out: make(chan []byte)})
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	s.Drain()
+	s.Drain()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Drain")
+	}
+}
+
+func TestSession_DrainStopInput(t *testing.T) {
+	n := unreachableNode(t, Options{RetryWindow: -1, PingInterval: time.Second})
+	in := make(chan []byte)
+	var stopped bool
+	s := NewSession(n, SessionOptions{Chat: true, In: in, Out: make(chan []byte), StopInput: func() {
+		stopped = true
+		close(in)
+	}})
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	s.Drain()
+	select {
+	case err := <-done:
+		if err != nil || !stopped {
+			t.Fatalf("want input stopped, got %v (stopped %v)", err, stopped)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after input closed")
+	}
+}
+
+func TestSession_FlushLines(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	out := make(chan []byte, 4)
+	s := NewSession(n, SessionOptions{Chat: true, Out: out})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte("hi\npart")})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "carol", To: "@ops", Data: []byte("half")})
+	s.flushLines()
+	close(out)
+	var got []string
+	for line := range out {
+		got = append(got, string(line))
+	}
+	want := []string{"bob>hi\n", "@ops/carol>half\n", "bob>part\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestSession_ChatFormatJSON(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	out := make(chan []byte, 4)
+	s := NewSession(n, SessionOptions{Chat: true, ChatFormat: ChatFormatJSON, Out: out})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte("two\nli"), More: true})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "carol", To: "@ops", Data: []byte("<hi>")})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte("nes")})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte{0xff}, More: true})
+	s.flushLines()
+	close(out)
+	var got []string
+	for line := range out {
+		got = append(got, string(line))
+	}
+	want := []string{
+		`{"from":"carol","to":"@ops","data":"<hi>"}` + "\n",
+		`{"from":"bob","data":"two\nlines"}` + "\n",
+		`{"from":"bob","data":"/w==","base64":true}` + "\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestSession_ChatControl(t *testing.T) {
+	n := unreachableNode(t, Options{})
+	out := make(chan []byte, 4)
+	s := NewSession(n, SessionOptions{Chat: true, ChatFormat: ChatFormatJSON, Out: out})
+	tests := []struct {
+		msg  *msgspec.RpipeMsg
+		want string
+	}{
+		{&msgspec.RpipeMsg{From: "bob", To: n.Name, Control: msgspec.ControlCall, Cid: "c1", Data: []byte("ping")},
+			`{"type":"call","from":"bob","cid":"c1","data":"ping"}`},
+		{&msgspec.RpipeMsg{From: "bob", To: n.Name, Control: msgspec.ControlStreamClose, Stream: 3},
+			`{"type":"close","from":"bob","stream":3,"data":""}`},
+		{&msgspec.RpipeMsg{From: "bob", To: n.Name, Control: msgspec.ControlEOF},
+			`{"type":"close","from":"bob","data":""}`},
+	}
+	for _, tt := range tests {
+		if !s.receiveChatControl(tt.msg) {
+			t.Fatalf("receiveChatControl(%s) = false", msgspec.ControlName(tt.msg.Control))
+		}
+		if got := string(<-out); got != tt.want+"\n" {
+			t.Errorf("want %s, got %s", tt.want, got)
+		}
+	}
+	if s.calls["c1"] != "bob" {
+		t.Errorf("call c1 not pending: %v", s.calls)
+	}
+	if s.receiveChatControl(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte("hi")}) {
+		t.Error("receiveChatControl() took a data message")
+	}
+
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Stream: 3, Data: []byte("a"), More: true})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Data: []byte("b")})
+	s.receiveRemote(&msgspec.RpipeMsg{From: "bob", To: n.Name, Stream: 3, Data: []byte("c")})
+	if got := string(<-out) + string(<-out); got != `{"from":"bob","data":"b"}`+"\n"+`{"from":"bob","stream":3,"data":"ac"}`+"\n" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,282 @@
+package rpipe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AllowList restricts the destinations a Forwarder dials for its peer.
+// An empty, non-nil list allows nothing.
+type AllowList []AllowRule
+
+// AllowRule matches destinations by host and port.
+type AllowRule struct {
+	// Host is a host name, '*.suffix' for any subdomain of suffix, '*' for
+	// any host, or an IP address or CIDR range. Addresses and ranges only
+	// match destinations given as IP addresses, since the name a client
+	// asks for is what the rule is checked against.
+	Host string
+	// MinPort and MaxPort bound the allowed ports, inclusive.
+	MinPort, MaxPort int
+
+	prefix *net.IPNet
+}
+
+// ParseAllowList parses comma-separated host:port rules. The port may be
+// a number, a range like 8000-8100, or '*'. IPv6 addresses and ranges are
+// written in brackets, e.g. [fd00::]/8 as [fd00::/8]:443.
+func ParseAllowList(s string) (AllowList, error) {
+	list := AllowList{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		rule, err := parseAllowRule(field)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+func parseAllowRule(s string) (AllowRule, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return AllowRule{}, fmt.Errorf("invalid allow rule '%s': expected host:port", s)
+	}
+	rule := AllowRule{Host: strings.ToLower(host)}
+	if strings.Contains(host, "/") {
+		_, rule.prefix, err = net.ParseCIDR(host)
+		if err != nil {
+			return AllowRule{}, fmt.Errorf("invalid allow rule '%s': %w", s, err)
+		}
+	}
+	if port == "*" {
+		rule.MinPort, rule.MaxPort = 1, 65535
+		return rule, nil
+	}
+	low, high, isRange := strings.Cut(port, "-")
+	if !isRange {
+		high = low
+	}
+	rule.MinPort, err = strconv.Atoi(low)
+	if err == nil {
+		rule.MaxPort, err = strconv.Atoi(high)
+	}
+	if err != nil || rule.MinPort < 1 || rule.MaxPort > 65535 || rule.MinPort > rule.MaxPort {
+		return AllowRule{}, fmt.Errorf("invalid allow rule '%s': bad port '%s'", s, port)
+	}
+	return rule, nil
+}
+
+// Permits reports whether any rule matches addr, a host:port.
+func (l AllowList) Permits(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, rule := range l {
+		if port >= rule.MinPort && port <= rule.MaxPort && rule.matchHost(host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AllowRule) matchHost(host string, ip net.IP) bool {
+	switch {
+	case r.Host == "*":
+		return true
+	case r.prefix != nil:
+		return ip != nil && r.prefix.Contains(ip)
+	case strings.HasPrefix(r.Host, "*."):
+		return ip == nil && strings.HasSuffix(host, r.Host[1:])
+	case ip != nil:
+		ruleIP := net.ParseIP(r.Host)
+		return ruleIP != nil && ruleIP.Equal(ip)
+	default:
+		return host == strings.TrimSuffix(r.Host, ".")
+	}
+}
+
+// resetNotAllowed is the reset reason for destinations outside the allow
+// list; SOCKS clients see it as a ruleset failure.
+const resetNotAllowed = "destination not allowed"
+
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded        = 0
+	socksGeneralFailure   = 1
+	socksNotAllowed       = 2
+	socksConnRefused      = 5
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation, including the peer
+// dialling the destination.
+const socksHandshakeTimeout = 30 * time.Second
+
+// ListenSOCKS runs a SOCKS5 server on addr. CONNECT requests are dialled
+// by the peer, subject to its allow list. Only the no-authentication
+// method is offered, so addr should be a loopback address.
+func (f *Forwarder) ListenSOCKS(addr string) error {
+	ln, err := f.listen(addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("SOCKS5 proxy on %s via %s", ln.Addr(), f.opts.Target)
+	go f.acceptLoop(ln, f.serveSOCKS)
+	return nil
+}
+
+func (f *Forwarder) serveSOCKS(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	dest, err := readSocksRequest(conn)
+	if err != nil {
+		log.Debugf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	st, err := f.mux.Open(dest)
+	if err != nil {
+		log.Warningln("Failed to open stream", err)
+		_ = writeSocksReply(conn, socksGeneralFailure)
+		_ = conn.Close()
+		return
+	}
+	log.Debugf("%s: SOCKS CONNECT from %s", st, conn.RemoteAddr())
+	ctx, cancel := context.WithTimeout(f.ctx, socksHandshakeTimeout)
+	err = st.WaitAccepted(ctx)
+	cancel()
+	if err != nil {
+		log.Infof("SOCKS CONNECT %s failed: %v", dest, err)
+		_ = writeSocksReply(conn, socksReplyCode(err))
+		_ = conn.Close()
+		_ = st.Reset(err.Error())
+		return
+	}
+	err = writeSocksReply(conn, socksSucceeded)
+	if err != nil {
+		_ = conn.Close()
+		_ = st.Reset(err.Error())
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	relay(conn, st)
+}
+
+// readSocksRequest negotiates the method and reads a CONNECT request,
+// returning its destination as host:port. Unsupported requests are
+// answered before the error is returned.
+func readSocksRequest(conn io.ReadWriter) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("client does not offer no-authentication")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksAddrIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSocksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		_ = writeSocksReply(conn, socksCmdNotSupported)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSocksReply answers a request. The bound address is not meaningful
+// through the tunnel, so it is always 0.0.0.0:0.
+func writeSocksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var resetErr *StreamResetError
+	if errors.As(err, &resetErr) {
+		switch {
+		case resetErr.Reason == resetNotAllowed:
+			return socksNotAllowed
+		case strings.Contains(resetErr.Reason, "connection refused"):
+			return socksConnRefused
+		}
+	}
+	return socksGeneralFailure
+}
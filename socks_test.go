@@ -0,0 +1,89 @@
+package rpipe
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAllowList_Permits(t *testing.T) {
+	list, err := ParseAllowList("grafana.internal:3000, *.corp.example:443,10.0.0.0/8:8000-8100,[fd00::/8]:*,192.168.1.5:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"grafana.internal:3000", true},
+		{"GRAFANA.internal:3000", true},
+		{"grafana.internal:3001", false},
+		{"wiki.corp.example:443", true},
+		{"a.b.corp.example:443", true},
+		{"corp.example:443", false},
+		{"evilcorp.example:443", false},
+		{"10.1.2.3:8050", true},
+		{"10.1.2.3:8101", false},
+		{"11.1.2.3:8050", false},
+		{"[fd00::1]:9", true},
+		{"192.168.1.5:22", true},
+		{"192.168.1.6:22", false},
+		{"no-port", false},
+	}
+	for _, tt := range tests {
+		if got := list.Permits(tt.addr); got != tt.want {
+			t.Errorf("Permits(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	empty, err := ParseAllowList("")
+	if err != nil || empty == nil || empty.Permits("grafana.internal:3000") {
+		t.Fatalf("empty list should deny everything, got %v, %v", empty, err)
+	}
+	all, _ := ParseAllowList("*:*")
+	if !all.Permits("anything:1") {
+		t.Fatal("*:* should allow everything")
+	}
+}
+
+func TestParseAllowList_Invalid(t *testing.T) {
+	for _, s := range []string{"grafana.internal", ":80", "host:0", "host:70000", "host:90-80", "host:http", "10.0.0.0/33:80"} {
+		if _, err := ParseAllowList(s); err == nil {
+			t.Errorf("ParseAllowList(%q): expected error", s)
+		}
+	}
+}
+
+func TestReadSocksRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		want    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"domain", []byte{5, 1, 0, 5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x1f, 0x90}, "localhost:8080", []byte{5, 0}, false},
+		{"ipv4", []byte{5, 2, 2, 0, 5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80", []byte{5, 0}, false},
+		{"ipv6", append(append([]byte{5, 1, 0, 5, 1, 0, 4}, net.ParseIP("fd00::1")...), 1, 187), "[fd00::1]:443", []byte{5, 0}, false},
+		{"auth only", []byte{5, 1, 2}, "", []byte{5, 0xff}, true},
+		{"bind", []byte{5, 1, 0, 5, 2, 0, 1, 10, 0, 0, 1, 0, 80}, "", []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0}, true},
+		{"socks4", []byte{4, 1, 0, 80}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var replied bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(tt.request), &replied}
+			got, err := readSocksRequest(conn)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("got %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if !bytes.Equal(replied.Bytes(), tt.reply) {
+				t.Fatalf("replied %v, want %v", replied.Bytes(), tt.reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package rpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sng2c/rpipe/msgspec"
+	"github.com/sng2c/rpipe/secure"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrKeysUnsupported = errors.New("crypto does not support listing or rotating symkeys")
+
+// KeyCrypto is implemented by Crypto implementations whose symkeys can be
+// listed and rotated on demand, as *secure.Cryptor does.
+type KeyCrypto interface {
+	Symkeys() []secure.SymkeyInfo
+	RotateOutboundSymkey(ctx context.Context, msg *msgspec.RpipeMsg) (*secure.SymKey, error)
+}
+
+// NodeStatus is a snapshot of a node for monitoring.
+type NodeStatus struct {
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode,omitempty"`
+	Version   string    `json:"version"`
+	Connected bool      `json:"connected"`
+	Started   time.Time `json:"started"`
+	// Peers are the nodes this node has exchanged messages with.
+	Peers    []string `json:"peers,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	Queues   []string `json:"queues,omitempty"`
+}
+
+// Status returns a snapshot of the node.
+func (n *Node) Status() NodeStatus {
+	peers := n.knownPeers()
+	sort.Strings(peers)
+	return NodeStatus{
+		Name:      n.Name,
+		Mode:      n.opts.Mode,
+		Version:   Version,
+		Connected: n.Connected(),
+		Started:   n.started,
+		Peers:     peers,
+		Groups:    n.Groups(),
+		Patterns:  n.Patterns(),
+		Queues:    n.Queues(),
+	}
+}
+
+// Symkeys lists the cached symkeys of this node's directions and groups.
+func (n *Node) Symkeys() ([]secure.SymkeyInfo, error) {
+	kc, ok := n.crypto.(KeyCrypto)
+	if !ok {
+		return nil, ErrKeysUnsupported
+	}
+	var infos []secure.SymkeyInfo
+	for _, info := range kc.Symkeys() {
+		from, to, pair := strings.Cut(info.Name, ":")
+		own := pair && (n.receivesOn(from) || n.receivesOn(to) || n.servesQueue(to))
+		if own || !pair && n.inGroup(info.Name) {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// RotateSymkey replaces the symkey of messages to peer, or to every peer
+// this node has talked to if peer is empty, and returns the peers whose
+// symkeys were replaced. Group keys change with the membership instead.
+func (n *Node) RotateSymkey(peer string) ([]string, error) {
+	kc, ok := n.crypto.(KeyCrypto)
+	if !ok {
+		return nil, ErrKeysUnsupported
+	}
+	if msgspec.IsGroup(peer) {
+		return nil, fmt.Errorf("cannot rotate the key of %s: group keys change when members join or leave", peer)
+	}
+	peers := []string{peer}
+	if peer == "" {
+		peers = n.knownPeers()
+		sort.Strings(peers)
+	}
+	for _, p := range peers {
+		_, err := kc.RotateOutboundSymkey(n.ctx, &msgspec.RpipeMsg{From: n.Name, To: p})
+		if err != nil {
+			return nil, fmt.Errorf("rotate symkey to %s: %w", p, err)
+		}
+	}
+	return peers, nil
+}
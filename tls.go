@@ -0,0 +1,61 @@
+package rpipe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configures TLS for rediss:// connections.
+type TLSOptions struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile hold a PEM client certificate and key.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name verified against the server certificate.
+	ServerName string
+	// InsecureSkipVerify disables server certificate verification.
+	InsecureSkipVerify bool
+}
+
+func (t *TLSOptions) isZero() bool {
+	return t == nil || *t == TLSOptions{}
+}
+
+// Config builds a tls.Config. Without ServerName the host of each
+// dialled address is verified.
+func (t *TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t == nil {
+		return config, nil
+	}
+	config.ServerName = t.ServerName
+	config.InsecureSkipVerify = t.InsecureSkipVerify
+
+	if t.CAFile != "" {
+		caPem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle '%s'", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,194 @@
+package rpipe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, _ := x509.MarshalECPrivateKey(c.key)
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// serveTLS accepts one connection requiring a client certificate signed by ca
+// and reports the handshake result.
+func serveTLS(t *testing.T, ca, server *testCert) (string, <-chan error) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	result := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- conn.(*tls.Conn).Handshake()
+	}()
+	return ln.Addr().String(), result
+}
+
+func TestTLSOptions_ClientCertHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "rpipe test CA", nil, true, 0)
+	server := newTestCert(t, "redis.internal", ca, false, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "rpipe client", ca, false, x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := client.writePEM(t, dir, "client")
+
+	config, err := (&TLSOptions{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "redis.internal",
+	}).Config()
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	addr, serverResult := serveTLS(t, ca, server)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	_ = conn.Close()
+	if err := <-serverResult; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+}
+
+func TestTLSOptions_WrongServerName(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "rpipe test CA", nil, true, 0)
+	server := newTestCert(t, "redis.internal", ca, false, x509.ExtKeyUsageServerAuth)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+
+	config, err := (&TLSOptions{CAFile: caFile, ServerName: "other.internal"}).Config()
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	addr, _ := serveTLS(t, ca, server)
+	conn, err := tls.Dial("tcp", addr, config)
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("expected verification error for mismatched server name")
+	}
+
+	config, err = (&TLSOptions{InsecureSkipVerify: true}).Config()
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	if !config.InsecureSkipVerify {
+		t.Fatal("expected InsecureSkipVerify to be set")
+	}
+}
+
+func TestTLSOptions_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestCert(t, "rpipe client", nil, false, x509.ExtKeyUsageClientAuth)
+	certFile, _ := client.writePEM(t, dir, "client")
+
+	if _, err := (&TLSOptions{CertFile: certFile}).Config(); err == nil {
+		t.Fatal("expected error for certificate without key")
+	}
+	if _, err := (&TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}).Config(); err == nil {
+		t.Fatal("expected error for missing CA bundle")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	_ = os.WriteFile(empty, []byte("not a certificate"), 0600)
+	if _, err := (&TLSOptions{CAFile: empty}).Config(); err == nil {
+		t.Fatal("expected error for CA bundle without certificates")
+	}
+}
+
+func TestRedisOptions_SetTLS(t *testing.T) {
+	opts, _ := ParseRedisURL("rediss://myredis:6380/0")
+	if !opts.TLS {
+		t.Fatal("expected rediss:// to enable TLS")
+	}
+	if err := opts.SetTLS(&TLSOptions{ServerName: "myredis"}); err != nil {
+		t.Fatalf("SetTLS: %v", err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.ServerName != "myredis" {
+		t.Fatalf("unexpected TLS config: %+v", opts.TLSConfig)
+	}
+
+	opts, _ = ParseRedisURL("redis-cluster://c1:7000,c2:7001?tls=true")
+	if err := opts.SetTLS(nil); err != nil || opts.TLSConfig == nil {
+		t.Fatalf("expected TLS config for tls=true, err = %v", err)
+	}
+
+	opts, _ = ParseRedisURL("redis://myredis:6379/0")
+	if err := opts.SetTLS(&TLSOptions{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("expected error for TLS options on plaintext URL")
+	}
+	if err := opts.SetTLS(&TLSOptions{}); err != nil || opts.TLSConfig != nil {
+		t.Fatalf("expected plaintext URL to stay plaintext, err = %v", err)
+	}
+}